@@ -0,0 +1,295 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/lib/pq"
+)
+
+// Config holds connection parameters for NewWithConfig. Any empty
+// field falls back to the value of the corresponding PG* environment
+// variable, or to the libpq default if that is not set.
+type Config struct {
+	// Host holds the host name of the server, or the directory
+	// holding its Unix socket (PGHOST).
+	Host string
+	// Port holds the port the server is listening on (PGPORT).
+	Port string
+	// User holds the name of the role to connect as (PGUSER).
+	User string
+	// Password holds the password for the role (PGPASSWORD).
+	Password string
+	// Database holds the name of the database in which the
+	// test schema is created (PGDATABASE).
+	Database string
+	// SSLMode holds the SSL mode to use, for example "disable"
+	// (PGSSLMODE).
+	SSLMode string
+}
+
+// params returns the connection parameters set in the config.
+func (cfg Config) params() map[string]string {
+	params := make(map[string]string)
+	for key, val := range map[string]string{
+		"host":     cfg.Host,
+		"port":     cfg.Port,
+		"user":     cfg.User,
+		"password": cfg.Password,
+		"dbname":   cfg.Database,
+		"sslmode":  cfg.SSLMode,
+	} {
+		if val != "" {
+			params[key] = val
+		}
+	}
+	return params
+}
+
+// NewWithConfig is like New except that the connection parameters in
+// cfg take precedence over the PG* environment variables.
+func NewWithConfig(cfg Config) (*DB, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+	return newDB(ctx, &options{conn: cfg.params()})
+}
+
+// DSN returns a libpq-style connection string that connects to the
+// test schema, suitable for passing to another process such as psql,
+// pg_dump or a migration tool. It includes the effective values of
+// all the connection parameters, whether they came from a Config or
+// from the PG* environment variables at the time the DB was created,
+// so it may contain a password. The test schema is selected with a
+// "-c search_path=..." argument in the options parameter.
+func (pg *DB) DSN() string {
+	return connString(libpqParams(pg.params))
+}
+
+// ConnConfig returns the connection parameters used by DSN, keyed by
+// libpq parameter name (for example "host" or "options"). The
+// returned map may be modified freely.
+func (pg *DB) ConnConfig() map[string]string {
+	return libpqParams(pg.params)
+}
+
+// envParams maps PG* environment variables to the connection
+// parameters they provide defaults for.
+var envParams = map[string]string{
+	"PGHOST":            "host",
+	"PGHOSTADDR":        "hostaddr",
+	"PGPORT":            "port",
+	"PGDATABASE":        "dbname",
+	"PGUSER":            "user",
+	"PGPASSWORD":        "password",
+	"PGOPTIONS":         "options",
+	"PGAPPNAME":         "application_name",
+	"PGSSLMODE":         "sslmode",
+	"PGSSLCERT":         "sslcert",
+	"PGSSLKEY":          "sslkey",
+	"PGSSLROOTCERT":     "sslrootcert",
+	"PGCONNECT_TIMEOUT": "connect_timeout",
+	"PGCLIENTENCODING":  "client_encoding",
+	"PGDATESTYLE":       "datestyle",
+	"PGTZ":              "timezone",
+}
+
+// effectiveParams returns the parameters set by the PG* environment
+// variables overridden by the given parameters.
+func effectiveParams(params map[string]string) map[string]string {
+	all := make(map[string]string)
+	for env, key := range envParams {
+		if val := os.Getenv(env); val != "" {
+			all[key] = val
+		}
+	}
+	for key, val := range params {
+		all[key] = val
+	}
+	return all
+}
+
+// libpqKeywords holds the connection parameters understood by libpq.
+// lib/pq sends any other parameter to the server as a run-time
+// setting, but libpq rejects them.
+var libpqKeywords = map[string]bool{
+	"host":                      true,
+	"hostaddr":                  true,
+	"port":                      true,
+	"dbname":                    true,
+	"user":                      true,
+	"password":                  true,
+	"passfile":                  true,
+	"connect_timeout":           true,
+	"client_encoding":           true,
+	"options":                   true,
+	"application_name":          true,
+	"fallback_application_name": true,
+	"keepalives":                true,
+	"keepalives_idle":           true,
+	"keepalives_interval":       true,
+	"keepalives_count":          true,
+	"sslmode":                   true,
+	"sslcompression":            true,
+	"sslcert":                   true,
+	"sslkey":                    true,
+	"sslrootcert":               true,
+	"sslcrl":                    true,
+	"requirepeer":               true,
+	"krbsrvname":                true,
+	"gsslib":                    true,
+	"service":                   true,
+	"target_session_attrs":      true,
+}
+
+// settingNames maps the run-time settings provided by PG*
+// environment variables to their canonical server names.
+var settingNames = map[string]string{
+	"datestyle": "DateStyle",
+	"timezone":  "TimeZone",
+}
+
+// libpqParams returns a copy of params in which every parameter that
+// is not a libpq keyword, such as search_path, is moved into the
+// options parameter as a "-c name=value" argument after any options
+// already set.
+func libpqParams(params map[string]string) map[string]string {
+	out := make(map[string]string)
+	var settings []string
+	for key, val := range params {
+		if libpqKeywords[key] {
+			out[key] = val
+			continue
+		}
+		if name, ok := settingNames[key]; ok {
+			key = name
+		}
+		settings = append(settings, "-c "+escapeOption(key+"="+val))
+	}
+	if len(settings) == 0 {
+		return out
+	}
+	sort.Strings(settings)
+	if opts := strings.TrimSpace(out["options"]); opts != "" {
+		settings = append([]string{opts}, settings...)
+	}
+	out["options"] = strings.Join(settings, " ")
+	return out
+}
+
+// escapeOption escapes a command-line argument for inclusion in the
+// options connection parameter, which libpq splits at spaces.
+func escapeOption(arg string) string {
+	arg = strings.Replace(arg, `\`, `\\`, -1)
+	return strings.Replace(arg, " ", `\ `, -1)
+}
+
+// driverParams returns a copy of params suitable for lib/pq, which
+// does not support hostaddr. As in libpq, hostaddr takes the place of
+// host as the address to connect to.
+func driverParams(params map[string]string) map[string]string {
+	out := make(map[string]string)
+	for key, val := range params {
+		out[key] = val
+	}
+	if addr, ok := out["hostaddr"]; ok {
+		delete(out, "hostaddr")
+		if addr != "" {
+			out["host"] = addr
+		}
+	}
+	return out
+}
+
+// connString returns a libpq-style connection string holding the
+// given parameters in a deterministic order.
+func connString(params map[string]string) string {
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, key := range keys {
+		parts[i] = key + "=" + quoteConnValue(params[key])
+	}
+	return strings.Join(parts, " ")
+}
+
+// parseConnString parses a libpq connection string, in either
+// keyword/value or URL form, into its parameters.
+func parseConnString(s string) (map[string]string, error) {
+	if strings.HasPrefix(s, "postgres://") || strings.HasPrefix(s, "postgresql://") {
+		kv, err := pq.ParseURL(s)
+		if err != nil {
+			return nil, err
+		}
+		s = kv
+	}
+	params := make(map[string]string)
+	r := []rune(s)
+	i := 0
+	skipSpace := func() {
+		for i < len(r) && unicode.IsSpace(r[i]) {
+			i++
+		}
+	}
+	for {
+		skipSpace()
+		if i >= len(r) {
+			return params, nil
+		}
+		start := i
+		for i < len(r) && r[i] != '=' && !unicode.IsSpace(r[i]) {
+			i++
+		}
+		key := string(r[start:i])
+		skipSpace()
+		if i >= len(r) || r[i] != '=' {
+			return nil, fmt.Errorf("missing %q after %q", "=", key)
+		}
+		i++
+		skipSpace()
+		var val []rune
+		if i < len(r) && r[i] == '\'' {
+			i++
+			for ; ; i++ {
+				if i < len(r) && r[i] == '\\' {
+					i++
+				} else if i < len(r) && r[i] == '\'' {
+					i++
+					break
+				}
+				if i >= len(r) {
+					return nil, fmt.Errorf("unterminated quoted value for %q", key)
+				}
+				val = append(val, r[i])
+			}
+		} else {
+			for ; i < len(r) && !unicode.IsSpace(r[i]); i++ {
+				if r[i] == '\\' && i+1 < len(r) {
+					i++
+				}
+				val = append(val, r[i])
+			}
+		}
+		params[key] = string(val)
+	}
+}
+
+// quoteConnValue quotes a value for inclusion in a connection string
+// if necessary.
+func quoteConnValue(val string) string {
+	if val != "" && !strings.ContainsAny(val, ` '\`+"\t\n\r") {
+		return val
+	}
+	val = strings.Replace(val, `\`, `\\`, -1)
+	val = strings.Replace(val, `'`, `\'`, -1)
+	return "'" + val + "'"
+}
@@ -0,0 +1,112 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest_test
+
+import (
+	"database/sql"
+	"errors"
+	"os/exec"
+	"regexp"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/postgrestest"
+)
+
+func TestNewWithConfigUnavailable(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	c.Setenv("PGTESTDISABLE", "")
+	// Nothing should be listening on port 1.
+	_, err := postgrestest.NewWithConfig(postgrestest.Config{
+		Host: "localhost",
+		Port: "1",
+	})
+	c.Assert(errors.Is(err, postgrestest.ErrUnavailable), qt.Equals, true)
+}
+
+func TestDSN(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.NewWithConfig(postgrestest.Config{})
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+	c.Assert(db.DSN(), qt.Matches, `(.* )?options='([^']* )?-c search_path=`+db.Schema()+`( [^']*)?'( .*)?`)
+
+	_, err = db.Exec(`CREATE TABLE x (id text)`)
+	c.Assert(err, qt.Equals, nil)
+
+	// A connection opened with the DSN uses the test schema.
+	other, err := sql.Open("postgres", db.DSN())
+	c.Assert(err, qt.Equals, nil)
+	defer other.Close()
+	var schema string
+	err = other.QueryRow(`SELECT table_schema FROM information_schema.tables WHERE table_name = 'x'`).Scan(&schema)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(schema, qt.Equals, db.Schema())
+	var n int
+	err = other.QueryRow(`SELECT COUNT(*) FROM x`).Scan(&n)
+	c.Assert(err, qt.Equals, nil)
+}
+
+func TestDSNSettings(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.NewWithOptions(postgrestest.WithDSN(`options='-c statement_timeout=5s' datestyle='ISO, MDY' timezone=UTC`))
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+	c.Assert(db.DSN(), qt.Matches, `(.* )?options='-c statement_timeout=5s -c DateStyle=ISO,\\\\ MDY -c TimeZone=UTC -c search_path=`+db.Schema()+`'( .*)?`)
+	// None of the settings are given as top-level parameters.
+	unquoted := regexp.MustCompile(`'(\\.|[^'\\])*'`).ReplaceAllString(db.DSN(), "''")
+	c.Assert(unquoted, qt.Not(qt.Matches), `(.* )?(datestyle|timezone|search_path)=.*`)
+}
+
+func TestDSNWithPsql(t *testing.T) {
+	c := qt.New(t)
+	if _, err := exec.LookPath("psql"); err != nil {
+		c.Skip("psql not available")
+	}
+	db, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+
+	// psql uses libpq, which rejects unknown connection parameters.
+	out, err := exec.Command("psql", "--no-psqlrc", "--tuples-only", "--no-align", "--dbname="+db.DSN(), "--command", "SELECT current_schema()").CombinedOutput()
+	c.Assert(err, qt.Equals, nil, qt.Commentf("output: %s", out))
+	c.Assert(strings.TrimSpace(string(out)), qt.Equals, db.Schema())
+}
+
+func TestConnConfig(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.NewWithConfig(postgrestest.Config{
+		SSLMode: "disable",
+	})
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+	params := db.ConnConfig()
+	c.Assert(params["options"], qt.Matches, `(.* )?-c search_path=`+db.Schema()+`( .*)?`)
+	c.Assert(params["sslmode"], qt.Equals, "disable")
+	_, ok := params["search_path"]
+	c.Assert(ok, qt.Equals, false)
+	// Changing the result does not affect the DB.
+	params["options"] = "other"
+	c.Assert(db.ConnConfig()["options"], qt.Not(qt.Equals), "other")
+}
+
+func TestOpen(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	_, err = db.Exec(`CREATE TABLE x (id text)`)
+	c.Assert(err, qt.Equals, nil)
+
+	other, err := db.Open()
+	c.Assert(err, qt.Equals, nil)
+	_, err = other.Exec(`INSERT INTO x VALUES ('a')`)
+	c.Assert(err, qt.Equals, nil)
+
+	c.Assert(db.Close(), qt.Equals, nil)
+	c.Assert(other.Ping(), qt.ErrorMatches, `sql: database is closed`)
+	_, err = db.Open()
+	c.Assert(err, qt.ErrorMatches, `cannot open database: test database has been closed`)
+}
@@ -0,0 +1,108 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest
+
+import (
+	"database/sql"
+	"sync"
+	"testing"
+	"time"
+)
+
+// connSampleInterval holds how often the number of open
+// connections is sampled.
+const connSampleInterval = 10 * time.Millisecond
+
+// connSampler keeps track of the maximum number of open
+// connections seen in a database connection pool.
+type connSampler struct {
+	db       *sql.DB
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	mu   sync.Mutex
+	peak int
+}
+
+// newConnSampler starts sampling the open connections of db.
+// The sampler must be stopped with Stop.
+func newConnSampler(db *sql.DB) *connSampler {
+	s := &connSampler{
+		db:   db,
+		stop: make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *connSampler) run() {
+	ticker := time.NewTicker(connSampleInterval)
+	defer ticker.Stop()
+	for {
+		s.sample()
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *connSampler) sample() {
+	n := s.db.Stats().OpenConnections
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n > s.peak {
+		s.peak = n
+	}
+}
+
+// Peak returns the largest number of open connections seen so far.
+func (s *connSampler) Peak() int {
+	s.sample()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peak
+}
+
+// Stop stops the sampler. It is OK to call Stop more than once,
+// or on a nil sampler.
+func (s *connSampler) Stop() {
+	if s == nil {
+		return
+	}
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+}
+
+// TrackConns starts keeping track of the number of connections
+// to the database open at the same time, for AssertMaxConnsUsed.
+// The connections are sampled periodically until the DB is closed,
+// so tracking is only started on request. It is OK to call
+// TrackConns more than once.
+func (pg *DB) TrackConns() {
+	pg.closeMu.Lock()
+	defer pg.closeMu.Unlock()
+	if pg.conns == nil && !pg.closed {
+		pg.conns = newConnSampler(pg.DB)
+	}
+}
+
+// AssertMaxConnsUsed fails the test if more than n connections
+// to the database have been open at the same time since TrackConns
+// was first called. Connections are sampled periodically, so very
+// short-lived peaks may be missed.
+func (pg *DB) AssertMaxConnsUsed(t testing.TB, n int) {
+	t.Helper()
+	pg.closeMu.Lock()
+	conns := pg.conns
+	pg.closeMu.Unlock()
+	if conns == nil {
+		t.Fatal("AssertMaxConnsUsed called without TrackConns")
+	}
+	if peak := conns.Peak(); peak > n {
+		t.Errorf("too many database connections used; got %d want at most %d", peak, n)
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/postgrestest"
+)
+
+func TestAssertMaxConnsUsed(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+	db.TrackConns()
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		conn, err := db.Conn(ctx)
+		c.Assert(err, qt.Equals, nil)
+		defer conn.Close()
+	}
+	db.AssertMaxConnsUsed(t, 3)
+
+	rt := &recordingTB{TB: t}
+	db.AssertMaxConnsUsed(rt, 2)
+	c.Assert(rt.errors, qt.DeepEquals, []string{"too many database connections used; got 3 want at most 2"})
+}
+
+// recordingTB records errors rather than failing the test.
+type recordingTB struct {
+	testing.TB
+	errors []string
+}
+
+func (t *recordingTB) Errorf(f string, a ...interface{}) {
+	t.errors = append(t.errors, fmt.Sprintf(f, a...))
+}
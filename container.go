@@ -0,0 +1,136 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// DefaultContainerImage holds the Docker image used by
+// NewWithContainer when none is specified.
+const DefaultContainerImage = "postgres:13"
+
+// containerStartTimeout holds the maximum time to wait for the
+// server in a new container to accept connections.
+const containerStartTimeout = 60 * time.Second
+
+// NewWithContainer is like New except that, rather than connecting to
+// an existing server, it starts a new Postgres server in a Docker
+// container using the given image (DefaultContainerImage if empty),
+// waits for it to accept connections and creates the test schema
+// there. The container is removed when the DB is closed. This makes
+// it possible to run tests in environments with no Postgres server
+// installed, such as CI, at the cost of a few seconds to start the
+// server.
+//
+// The docker binary must be available in $PATH. The server is only
+// reachable on the loopback interface, using a random password, and
+// the PG* environment variables are not used to connect to it; use
+// DSN to connect to it from elsewhere.
+//
+// If the environment variable PGTESTKEEPDB is non-empty, the
+// container is left running when the DB is closed and its ID is
+// printed.
+func NewWithContainer(image string) (*DB, error) {
+	if PgTestDisable() {
+		return nil, ErrDisabled
+	}
+	if image == "" {
+		image = DefaultContainerImage
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), containerStartTimeout)
+	defer cancel()
+	password := randomName("")
+	id, err := docker(ctx, "run",
+		"--detach",
+		"--rm",
+		"--publish", "127.0.0.1::5432",
+		"--env", "POSTGRES_PASSWORD="+password,
+		image,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("cannot start container from image %s: %w", image, err)
+	}
+	db, err := newContainerDB(ctx, id, password)
+	if err != nil {
+		if errRemove := removeContainer(context.Background(), id); errRemove != nil {
+			fmt.Fprintf(os.Stderr, "postgrestest: %v\n", errRemove)
+		}
+		return nil, err
+	}
+	return db, nil
+}
+
+// newContainerDB creates a test schema in the server running in the
+// given container, waiting for the server to become ready.
+func newContainerDB(ctx context.Context, id, password string) (*DB, error) {
+	addr, err := docker(ctx, "port", id, "5432/tcp")
+	if err != nil {
+		return nil, fmt.Errorf("cannot find port of container %s: %w", id, err)
+	}
+	// There may be several lines, one for each address.
+	addr = strings.SplitN(addr, "\n", 2)[0]
+	i := strings.LastIndex(addr, ":")
+	if i == -1 {
+		return nil, fmt.Errorf("unexpected address %q for container %s", addr, id)
+	}
+	cfg := Config{
+		Host:     addr[:i],
+		Port:     addr[i+1:],
+		User:     "postgres",
+		Password: password,
+		Database: "postgres",
+		SSLMode:  "disable",
+	}
+	if err := waitUntilReady(ctx, "postgres", connString(cfg.params()), 250*time.Millisecond); err != nil {
+		return nil, fmt.Errorf("cannot connect to server in container %s: %w", id, err)
+	}
+	db, err := newDB(ctx, &options{conn: cfg.params()})
+	if err != nil {
+		return nil, err
+	}
+	db.container = id
+	return db, nil
+}
+
+// removeContainer removes the container started by NewWithContainer,
+// unless PGTESTKEEPDB is set.
+func (pg *DB) removeContainer(ctx context.Context) error {
+	if pg.keepDB() {
+		fmt.Fprintf(os.Stderr, "postgrestest container: %v\n", pg.container)
+		fmt.Fprintf(os.Stderr, "\tdocker rm --force %s\n", pg.container)
+		return nil
+	}
+	return removeContainer(ctx, pg.container)
+}
+
+// removeContainer stops and removes the container with the given ID.
+func removeContainer(ctx context.Context, id string) error {
+	if _, err := docker(ctx, "rm", "--force", id); err != nil {
+		return fmt.Errorf("cannot remove container %s: %w", id, err)
+	}
+	return nil
+}
+
+// docker runs the docker command with the given arguments and
+// returns its trimmed output.
+func docker(ctx context.Context, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "docker", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("docker %s: %s: %w", args[0], msg, err)
+		}
+		return "", fmt.Errorf("docker %s: %w", args[0], err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
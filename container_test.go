@@ -0,0 +1,30 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest_test
+
+import (
+	"os/exec"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/postgrestest"
+)
+
+func TestNewWithContainer(t *testing.T) {
+	c := qt.New(t)
+	if _, err := exec.LookPath("docker"); err != nil {
+		c.Skip("docker is not available")
+	}
+	db, err := postgrestest.NewWithContainer("")
+	if err == postgrestest.ErrDisabled {
+		c.Skip("postgres testing is disabled")
+	}
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+	c.Assert(db.DSN(), qt.Matches, `.*host=127\.0\.0\.1 .*`)
+
+	_, err = db.Exec(`CREATE TABLE x (id text)`)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(db.Close(), qt.Equals, nil)
+}
@@ -0,0 +1,190 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// inUseRetries holds the number of times an operation that fails
+// because a database is being accessed by other users is retried.
+const inUseRetries = 5
+
+// inUseRetryDelay holds the delay between such retries.
+const inUseRetryDelay = 100 * time.Millisecond
+
+// NewDB is like New except that, rather than creating a schema, it
+// creates a new database with a random name and connects to that.
+// Close drops the database rather than a schema. This gives better
+// isolation than a schema for code that uses extensions or multiple
+// schemas or that relies on the public schema.
+//
+// The Schema method of the returned DB returns the current schema of
+// the new database (usually "public"), so methods that operate on the
+// test schema act on that.
+//
+// The connecting role needs the CREATEDB privilege. As with New,
+// PGTESTDISABLE and PGTESTKEEPDB are honoured.
+func NewDB() (*DB, error) {
+	return newDatabase("")
+}
+
+// newDatabase implements NewDB and NewFromTemplate. If templateName
+// is non-empty, the new database is created from that template.
+func newDatabase(templateName string) (*DB, error) {
+	if PgTestDisable() {
+		return nil, ErrDisabled
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+	admin, err := sql.Open("postgres", "")
+	if err != nil {
+		return nil, fmt.Errorf("cannot open database: %w", err)
+	}
+	defer admin.Close()
+	if err := ping(ctx, admin); err != nil {
+		return nil, err
+	}
+
+	name := randomSchemaName()
+	if err := createDatabase(ctx, admin, name, templateName); err != nil {
+		return nil, err
+	}
+
+	params := map[string]string{"dbname": name}
+	dataSource := connString(params)
+	db, err := openDatabase(ctx, name, dataSource)
+	if err == nil {
+		var schema string
+		err = runWithContext(ctx, func(ctx context.Context) error {
+			return db.QueryRowContext(ctx, `SELECT current_schema()`).Scan(&schema)
+		}, "connect to test database "+name)
+		if err == nil {
+			return &DB{
+				DB:         db,
+				schema:     schema,
+				database:   name,
+				template:   templateName,
+				driverName: "postgres",
+				dataSource: dataSource,
+				params:     effectiveParams(params),
+			}, nil
+		}
+		db.Close()
+	}
+	dropCtx, dropCancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer dropCancel()
+	if errDrop := dropDatabase(dropCtx, name); errDrop != nil {
+		fmt.Fprintf(os.Stderr, "postgrestest: %v\n", errDrop)
+	}
+	return nil, err
+}
+
+// createDatabase creates the named database using admin, copying the
+// named template database if templateName is non-empty.
+func createDatabase(ctx context.Context, admin *sql.DB, name, templateName string) error {
+	stmt := "CREATE DATABASE " + pq.QuoteIdentifier(name)
+	what := "create test database " + name
+	if templateName != "" {
+		stmt += " TEMPLATE " + pq.QuoteIdentifier(templateName)
+		what += " from template " + templateName
+	}
+	return runWithContext(ctx, func(ctx context.Context) error {
+		return retryInUse(ctx, func() error {
+			_, err := admin.ExecContext(ctx, stmt)
+			return err
+		})
+	}, what)
+}
+
+// openDatabase opens the named database created by createDatabase
+// using the given data source, and records its creation time so that
+// CleanupStale can find the database if it is never dropped.
+func openDatabase(ctx context.Context, name, dataSource string) (*sql.DB, error) {
+	db, err := sql.Open("postgres", dataSource)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open database: %w", err)
+	}
+	err = runWithContext(ctx, func(ctx context.Context) error {
+		_, err := db.ExecContext(ctx, `COMMENT ON DATABASE `+pq.QuoteIdentifier(name)+` IS `+createdComment())
+		return err
+	}, "connect to test database "+name)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// closeDatabase closes the connection to a database created by NewDB
+// or NewFromTemplate and then drops the database, or returns it to the
+// DatabasePool it came from. It must be called with pg.closeMu held.
+func (pg *DB) closeDatabase(ctx context.Context) error {
+	if pg.dropped {
+		return nil
+	}
+	if pg.keepDB() {
+		fmt.Fprintf(os.Stderr, "postgrestest database: %v\n", pg.database)
+		fmt.Fprintf(os.Stderr, "\tDROP DATABASE %q;\n", pg.database)
+		return nil
+	}
+	// The database cannot be dropped while we are still connected
+	// to it.
+	err := runWithContext(ctx, func(context.Context) error {
+		return pg.DB.Close()
+	}, "close test db")
+	if err != nil {
+		return err
+	}
+	if pg.pool != nil {
+		// The database is dropped only if the pool has no room
+		// for it.
+		if err := pg.pool.put(ctx, pg.database); err != nil {
+			return err
+		}
+	} else if err := dropDatabase(ctx, pg.database); err != nil {
+		return err
+	}
+	pg.dropped = true
+	return nil
+}
+
+// dropDatabase drops the named database using a new connection.
+func dropDatabase(ctx context.Context, name string) error {
+	db, err := sql.Open("postgres", "")
+	if err != nil {
+		return fmt.Errorf("cannot open database: %w", err)
+	}
+	defer db.Close()
+	stmt := "DROP DATABASE " + pq.QuoteIdentifier(name)
+	return runWithContext(ctx, func(ctx context.Context) error {
+		return retryInUse(ctx, func() error {
+			_, err := db.ExecContext(ctx, stmt)
+			return err
+		})
+	}, "drop test database "+name)
+}
+
+// retryInUse calls f, retrying a few times while it fails because a
+// database is being accessed by other users.
+func retryInUse(ctx context.Context, f func() error) error {
+	for i := 0; ; i++ {
+		err := f()
+		// object_in_use
+		if SQLState(err) != "55006" || i >= inUseRetries {
+			return err
+		}
+		select {
+		case <-time.After(inUseRetryDelay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
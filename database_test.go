@@ -0,0 +1,37 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest_test
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/postgrestest"
+)
+
+func TestNewDB(t *testing.T) {
+	c := qt.New(t)
+	admin, err := postgrestest.NewConn()
+	c.Assert(err, qt.Equals, nil)
+	defer admin.Close()
+	skipUnlessSuperuser(c, admin)
+
+	db, err := postgrestest.NewDB()
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(db.Schema(), qt.Equals, "public")
+	var name string
+	err = db.QueryRow(`SELECT current_database()`).Scan(&name)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(name, qt.Matches, `go_test_[0-9a-f]+`)
+
+	// Other schemas can be used freely.
+	_, err = db.Exec(`CREATE SCHEMA other; CREATE TABLE other.x (id text)`)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(db.Close(), qt.Equals, nil)
+
+	var count int
+	err = admin.QueryRow(`SELECT COUNT(*) FROM pg_database WHERE datname = $1`, name).Scan(&count)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(count, qt.Equals, 0)
+}
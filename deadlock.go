@@ -0,0 +1,79 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// deadlockTimeout holds how long ForceDeadlock waits for Postgres
+// to detect the deadlock. Detection happens after the server's
+// deadlock_timeout, which defaults to one second.
+const deadlockTimeout = 3 * defaultTimeout
+
+// ForceDeadlock deterministically produces a deadlock between two
+// sessions and returns the error received by the session that
+// Postgres chose as the victim. This can be used to check that code
+// handles deadlock errors (SQLSTATE 40P01) correctly.
+//
+// Each of lockA and lockB should be a statement that acquires a
+// lock, for example "UPDATE x SET val = val WHERE id = 1". Two
+// transactions are started: the first executes lockA and the second
+// lockB. Once both have done so, the first executes lockB and the
+// second lockA concurrently, so each waits for the other. Both
+// transactions are rolled back before ForceDeadlock returns.
+//
+// If the statements do not deadlock, or fail for another reason, a
+// non-deadlock error is returned.
+func (pg *DB) ForceDeadlock(lockA, lockB string) (victimErr error) {
+	ctx, cancel := context.WithTimeout(context.Background(), deadlockTimeout)
+	defer cancel()
+	txA, err := pg.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("cannot start transaction: %w", err)
+	}
+	defer txA.Rollback()
+	txB, err := pg.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("cannot start transaction: %w", err)
+	}
+	defer txB.Rollback()
+
+	if _, err := txA.ExecContext(ctx, lockA); err != nil {
+		return fmt.Errorf("cannot acquire first lock: %w", err)
+	}
+	if _, err := txB.ExecContext(ctx, lockB); err != nil {
+		return fmt.Errorf("cannot acquire second lock: %w", err)
+	}
+	errs := make(chan error, 2)
+	exec := func(tx *sql.Tx, stmt string) {
+		_, err := tx.ExecContext(ctx, stmt)
+		errs <- err
+	}
+	go exec(txA, lockB)
+	go exec(txB, lockA)
+	var otherErr error
+	for i := 0; i < 2; i++ {
+		err := <-errs
+		switch {
+		case err == nil:
+		case SQLState(err) == "40P01":
+			victimErr = err
+		case ctx.Err() != nil:
+			otherErr = fmt.Errorf("timed out after %v waiting for deadlock", deadlockTimeout)
+		case otherErr == nil:
+			otherErr = fmt.Errorf("cannot force deadlock: %w", err)
+		}
+	}
+	if victimErr != nil {
+		return victimErr
+	}
+	if otherErr != nil {
+		return otherErr
+	}
+	return errors.New("statements did not deadlock")
+}
@@ -0,0 +1,39 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest_test
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/postgrestest"
+)
+
+func TestForceDeadlock(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+
+	_, err = db.Exec(`
+		CREATE TABLE x (id integer PRIMARY KEY, val text);
+		INSERT INTO x (id, val) VALUES (1, 'a'), (2, 'b');
+	`)
+	c.Assert(err, qt.Equals, nil)
+	err = db.ForceDeadlock(
+		`UPDATE x SET val = 'c' WHERE id = 1`,
+		`UPDATE x SET val = 'd' WHERE id = 2`,
+	)
+	c.Assert(err, qt.ErrorMatches, `.*deadlock detected`)
+	c.Assert(postgrestest.SQLState(err), qt.Equals, "40P01")
+
+	// Both transactions should have been rolled back.
+	var count int
+	err = db.QueryRow(`SELECT COUNT(*) FROM x WHERE val IN ('a', 'b')`).Scan(&count)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(count, qt.Equals, 2)
+
+	err = db.ForceDeadlock(`SELECT 1`, `SELECT 2`)
+	c.Assert(err, qt.ErrorMatches, `statements did not deadlock`)
+}
@@ -0,0 +1,57 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+)
+
+// driverNames holds the names of the database/sql drivers that
+// RunOnAllDrivers knows about: "postgres" is registered by
+// github.com/lib/pq and "pgx" by github.com/jackc/pgx/stdlib.
+var driverNames = []string{"postgres", "pgx"}
+
+// RunOnAllDrivers runs f as a subtest once for each known Postgres
+// driver that has been registered with database/sql, passing it a
+// DB created with that driver. Each subtest is named after its
+// driver. Drivers that have not been linked into the test binary
+// are skipped.
+//
+// The lib/pq driver is always available. To also run against pgx,
+// import its database/sql driver in the test:
+//
+//	import _ "github.com/jackc/pgx/v4/stdlib"
+//
+// If postgres testing is disabled, the subtests are skipped.
+func RunOnAllDrivers(t *testing.T, f func(t *testing.T, db *DB)) {
+	registered := make(map[string]bool)
+	for _, name := range sql.Drivers() {
+		registered[name] = true
+	}
+	for _, name := range driverNames {
+		name := name
+		t.Run(name, func(t *testing.T) {
+			if !registered[name] {
+				t.Skipf("driver %q is not registered", name)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+			db, err := newDB(ctx, &options{driverName: name})
+			cancel()
+			if err == ErrDisabled {
+				t.Skip(err)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				if err := db.Close(); err != nil {
+					t.Error(err)
+				}
+			}()
+			f(t, db)
+		})
+	}
+}
@@ -0,0 +1,25 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest_test
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/postgrestest"
+)
+
+func TestRunOnAllDrivers(t *testing.T) {
+	var schemas []string
+	postgrestest.RunOnAllDrivers(t, func(t *testing.T, db *postgrestest.DB) {
+		c := qt.New(t)
+		var schema string
+		err := db.QueryRow(`SELECT current_schema()`).Scan(&schema)
+		c.Assert(err, qt.Equals, nil)
+		c.Assert(schema, qt.Equals, db.Schema())
+		schemas = append(schemas, schema)
+	})
+	// The lib/pq driver is always registered.
+	qt.New(t).Assert(schemas, qt.Not(qt.HasLen), 0)
+}
@@ -0,0 +1,49 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// DumpToFile writes a dump of the test schema to the file at the
+// given path by running pg_dump. The dump includes table data and
+// all schema objects (indexes, constraints, sequences, ownership and
+// so on) and can be restored with psql. Combined with PGTESTKEEPDB,
+// this can be used to preserve the state of a failing test.
+//
+// The pg_dump binary must be available in $PATH. It connects with
+// the parameters returned by DSN, so it dumps from the same server
+// and database as the DB, including one created by NewDB or
+// NewWithContainer. Note that pg_dump refuses to dump from a server
+// with a newer major version than itself, so the installed client
+// should be at least as new as the server.
+func (pg *DB) DumpToFile(path string) error {
+	// Pass any password in the environment rather than on the
+	// command line, where other users could see it.
+	params := pg.ConnConfig()
+	password, hasPassword := params["password"]
+	delete(params, "password")
+	cmd := exec.Command("pg_dump",
+		"--dbname="+connString(params),
+		"--schema", `"`+pg.schema+`"`,
+		"--file", path,
+	)
+	if hasPassword {
+		cmd.Env = append(os.Environ(), "PGPASSWORD="+password)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("cannot dump schema %s: %s: %w", pg.schema, msg, err)
+		}
+		return fmt.Errorf("cannot dump schema %s: %w", pg.schema, err)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest_test
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/postgrestest"
+)
+
+func TestDumpToFile(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	if _, err := exec.LookPath("pg_dump"); err != nil {
+		c.Skip("pg_dump not available")
+	}
+	db, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+
+	_, err = db.Exec(`CREATE TABLE x (id text PRIMARY KEY, val text)`)
+	c.Assert(err, qt.Equals, nil)
+	_, err = db.Exec(`INSERT INTO x (id, val) VALUES ('a', 'b')`)
+	c.Assert(err, qt.Equals, nil)
+
+	path := filepath.Join(c.Mkdir(), "dump.sql")
+	err = db.DumpToFile(path)
+	c.Assert(err, qt.Equals, nil)
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(data), qt.Matches, `(?s).*CREATE TABLE `+db.Schema()+`\.x .*PRIMARY KEY.*`)
+}
+
+func TestDumpToFileDatabase(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	if _, err := exec.LookPath("pg_dump"); err != nil {
+		c.Skip("pg_dump not available")
+	}
+	db, err := postgrestest.NewDB()
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+
+	_, err = db.Exec(`CREATE TABLE only_in_test_database (id text)`)
+	c.Assert(err, qt.Equals, nil)
+
+	path := filepath.Join(c.Mkdir(), "dump.sql")
+	err = db.DumpToFile(path)
+	c.Assert(err, qt.Equals, nil)
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(string(data), qt.Matches, `(?s).*CREATE TABLE `+db.Schema()+`\.only_in_test_database .*`)
+}
@@ -0,0 +1,113 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// ErrUnavailable is returned, wrapped with more information, by New
+// and other functions that connect to the server when no Postgres
+// server can be reached or the connection is refused. Use errors.Is
+// to check for it, for example to decide whether to skip a test.
+var ErrUnavailable = errors.New("postgres server is unavailable")
+
+// ErrUnsupported is returned, wrapped with more information, when the
+// server lacks a feature required by a test, such as a minimum version
+// or an extension. Use errors.Is to check for it, for example to decide
+// whether to skip a test; NewForTest skips the test automatically.
+var ErrUnsupported = errors.New("unsupported by postgres server")
+
+// unavailableError wraps a connection error so that it matches
+// ErrUnavailable while still unwrapping to the underlying cause.
+type unavailableError struct {
+	cause error
+	// hint holds a hint on how to fix the problem.
+	hint string
+}
+
+func (e *unavailableError) Error() string {
+	return fmt.Sprintf("%v: %v (%s)", ErrUnavailable, e.cause, e.hint)
+}
+
+// Is implements errors.Is.
+func (e *unavailableError) Is(target error) bool {
+	return target == ErrUnavailable
+}
+
+// Unwrap implements errors.Unwrap.
+func (e *unavailableError) Unwrap() error {
+	return e.cause
+}
+
+// unsupportedError wraps an error that shows the server lacks a
+// feature so that it matches ErrUnsupported while still unwrapping to
+// the underlying cause.
+type unsupportedError struct {
+	// msg describes what is unsupported.
+	msg   string
+	cause error
+}
+
+func (e *unsupportedError) Error() string {
+	return fmt.Sprintf("%v: %s: %v", ErrUnsupported, e.msg, e.cause)
+}
+
+// Is implements errors.Is.
+func (e *unsupportedError) Is(target error) bool {
+	return target == ErrUnsupported
+}
+
+// Unwrap implements errors.Unwrap.
+func (e *unsupportedError) Unwrap() error {
+	return e.cause
+}
+
+// connectionHint returns a hint describing how the connection to the
+// server has been configured.
+func connectionHint() string {
+	var vars []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "PG") || strings.HasPrefix(kv, "PGTEST") {
+			continue
+		}
+		if strings.HasPrefix(kv, "PGPASSWORD=") {
+			kv = "PGPASSWORD=<hidden>"
+		}
+		vars = append(vars, kv)
+	}
+	sort.Strings(vars)
+	const msg = "check that a Postgres server is running and that the PG* environment variables are correct"
+	if len(vars) == 0 {
+		return msg + "; none are set, so libpq defaults are used"
+	}
+	return msg + "; currently " + strings.Join(vars, " ")
+}
+
+// SQLState returns the five-character SQLSTATE code of the
+// Postgres error wrapped by err (for example "23505" for a
+// unique_violation), or the empty string if there is none.
+//
+// It recognizes *pq.Error from github.com/lib/pq and any error
+// with a SQLState method, such as *pgconn.PgError from
+// github.com/jackc/pgx.
+func SQLState(err error) string {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return string(pqErr.Code)
+	}
+	var stateErr interface {
+		SQLState() string
+	}
+	if errors.As(err, &stateErr) {
+		return stateErr.SQLState()
+	}
+	return ""
+}
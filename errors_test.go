@@ -0,0 +1,73 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/postgrestest"
+	"github.com/lib/pq"
+)
+
+var sqlStateTests = []struct {
+	about  string
+	err    error
+	expect string
+}{{
+	about: "nil error",
+}, {
+	about: "non-postgres error",
+	err:   errors.New("something"),
+}, {
+	about:  "pq error",
+	err:    &pq.Error{Code: "23505"},
+	expect: "23505",
+}, {
+	about:  "wrapped pq error",
+	err:    fmt.Errorf("cannot insert: %w", &pq.Error{Code: "23505"}),
+	expect: "23505",
+}, {
+	about:  "wrapped error with SQLState method",
+	err:    fmt.Errorf("cannot insert: %w", stateError("40P01")),
+	expect: "40P01",
+}}
+
+func TestSQLState(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range sqlStateTests {
+		c.Run(test.about, func(c *qt.C) {
+			c.Assert(postgrestest.SQLState(test.err), qt.Equals, test.expect)
+		})
+	}
+}
+
+// stateError is an error that implements the SQLState method
+// in the same way as *pgconn.PgError.
+type stateError string
+
+func (e stateError) Error() string {
+	return "error " + string(e)
+}
+
+func (e stateError) SQLState() string {
+	return string(e)
+}
+
+func TestErrUnavailable(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	// Nothing should be listening on port 1.
+	c.Setenv("PGHOST", "127.0.0.1")
+	c.Setenv("PGPORT", "1")
+	c.Setenv("PGPASSWORD", "secret")
+	_, err := postgrestest.New()
+	c.Assert(errors.Is(err, postgrestest.ErrUnavailable), qt.Equals, true)
+	c.Assert(err, qt.ErrorMatches, `postgres server is unavailable: cannot connect to database: .*connection refused \(check that .*; currently .*PGHOST=127.0.0.1 PGPASSWORD=<hidden> PGPORT=1.*\)`)
+
+	_, err = postgrestest.NewConn()
+	c.Assert(errors.Is(err, postgrestest.ErrUnavailable), qt.Equals, true)
+}
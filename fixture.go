@@ -0,0 +1,396 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// FixtureOptions holds options for loading fixtures.
+type FixtureOptions struct {
+	// Validate specifies that all the tables and columns
+	// referred to by the fixtures should be checked against
+	// the schema before any rows are inserted, so that all
+	// mismatches are reported together.
+	Validate bool
+
+	// BatchSize holds the maximum number of rows inserted by a
+	// single multi-row INSERT statement. Larger batches need
+	// fewer round trips but more memory. If it is zero,
+	// DefaultFixtureBatchSize is used. Batching does not affect
+	// the result, but when a batch fails, errors can only
+	// identify the range of rows in the batch.
+	BatchSize int
+}
+
+// DefaultFixtureBatchSize holds the default value of
+// FixtureOptions.BatchSize.
+const DefaultFixtureBatchSize = 100
+
+// maxParams holds the maximum number of parameters allowed in a
+// single statement by the Postgres protocol.
+const maxParams = 65535
+
+// LoadFixturesYAML inserts the rows held in the YAML file at the
+// given path into tables in the test schema. The file must hold
+// a mapping from table name to a list of rows, each of which is
+// a mapping from column name to value. For example:
+//
+//	users:
+//	- id: 1
+//	  name: alice
+//	- id: 2
+//	  name: bob
+//	orders:
+//	- id: 10
+//	  user_id: 1
+//	  items: [apple, pear]
+//	  details: {rush: true}
+//
+// Tables are loaded in the order they appear in the file, and
+// all the rows are inserted in a single transaction. Consecutive
+// rows with the same columns are inserted in batches (see
+// FixtureOptions.BatchSize).
+//
+// The file may be gzip-compressed, as with LoadSQLFile.
+//
+// Values are converted according to the type of the column they
+// are inserted into: values for json and jsonb columns are
+// encoded as JSON, and lists are inserted into array columns as
+// Postgres arrays. Other values are passed to the database
+// unchanged.
+//
+// If opts is nil, the default options are used.
+func (pg *DB) LoadFixturesYAML(path string, opts *FixtureOptions) error {
+	data, err := readFileMaybeGzipped(path)
+	if err != nil {
+		return fmt.Errorf("cannot read fixtures: %w", err)
+	}
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("cannot parse fixtures from %s: %w", path, err)
+	}
+	tables := make([]fixtureTable, len(doc))
+	for i, item := range doc {
+		name, ok := item.Key.(string)
+		if !ok {
+			return fmt.Errorf("cannot parse fixtures from %s: invalid table name %v", path, item.Key)
+		}
+		tables[i].name = name
+		if item.Value == nil {
+			continue
+		}
+		rows, ok := item.Value.([]interface{})
+		if !ok {
+			return fmt.Errorf("cannot parse fixtures from %s: table %q does not hold a list of rows", path, name)
+		}
+		for j, row := range rows {
+			m, ok := normalizeYAML(row).(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("cannot parse fixtures from %s: table %q row %d is not a mapping", path, name, j)
+			}
+			tables[i].rows = append(tables[i].rows, m)
+		}
+	}
+	return pg.loadFixtures(path, tables, opts)
+}
+
+// LoadFixturesJSON is like LoadFixturesYAML except that the
+// fixtures are read from a JSON file holding an object that maps
+// table names to arrays of row objects.
+func (pg *DB) LoadFixturesJSON(path string, opts *FixtureOptions) error {
+	data, err := readFileMaybeGzipped(path)
+	if err != nil {
+		return fmt.Errorf("cannot read fixtures: %w", err)
+	}
+	tables, err := parseJSONFixtures(data)
+	if err != nil {
+		return fmt.Errorf("cannot parse fixtures from %s: %w", path, err)
+	}
+	return pg.loadFixtures(path, tables, opts)
+}
+
+// WithTriggersDisabled disables all triggers on the given tables in
+// the test schema, calls fn, and then enables the triggers again,
+// even if fn fails. Because foreign key constraints are enforced by
+// internal triggers, this allows rows with circular or dangling
+// references to be loaded into tables whose constraints are not
+// deferrable.
+//
+// This is intended for test setup only: the triggers are disabled
+// for all sessions, not just the caller's, and nothing checks the
+// constraints after they are enabled again. It requires ownership of
+// the tables, and disabling the internal constraint triggers also
+// requires superuser privileges.
+func (pg *DB) WithTriggersDisabled(tables []string, fn func() error) (err error) {
+	alter := func(tables []string, action string) error {
+		for _, table := range tables {
+			if _, err := pg.DB.Exec(fmt.Sprintf("ALTER TABLE %s %s TRIGGER ALL", pq.QuoteIdentifier(table), action)); err != nil {
+				return fmt.Errorf("cannot %s triggers on %q: %w", strings.ToLower(action), table, err)
+			}
+		}
+		return nil
+	}
+	for i, table := range tables {
+		if err := alter([]string{table}, "DISABLE"); err != nil {
+			alter(tables[:i], "ENABLE")
+			return err
+		}
+	}
+	defer func() {
+		if enableErr := alter(tables, "ENABLE"); enableErr != nil && err == nil {
+			err = enableErr
+		}
+	}()
+	return fn()
+}
+
+// fixtureTable holds the rows to be inserted into a table.
+type fixtureTable struct {
+	name string
+	rows []map[string]interface{}
+}
+
+// parseJSONFixtures parses a JSON fixtures object, preserving the
+// order of the tables.
+func parseJSONFixtures(data []byte) ([]fixtureTable, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if tok, err := dec.Token(); err != nil {
+		return nil, err
+	} else if tok != json.Delim('{') {
+		return nil, errors.New("fixtures are not a JSON object")
+	}
+	var tables []fixtureTable
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		t := fixtureTable{
+			name: tok.(string),
+		}
+		if err := dec.Decode(&t.rows); err != nil {
+			return nil, fmt.Errorf("invalid rows for table %q: %w", t.name, err)
+		}
+		tables = append(tables, t)
+	}
+	return tables, nil
+}
+
+// loadFixtures inserts all the given rows in a single transaction.
+// The path is used for error messages only.
+func (pg *DB) loadFixtures(path string, tables []fixtureTable, opts *FixtureOptions) error {
+	if opts == nil {
+		opts = &FixtureOptions{}
+	}
+	tx, err := pg.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("cannot start transaction: %w", err)
+	}
+	defer tx.Rollback()
+	tableTypes := make([]map[string]string, len(tables))
+	for i, t := range tables {
+		types, err := columnTypes(tx, pg.schema, t.name)
+		if err != nil {
+			return fmt.Errorf("cannot load fixtures from %s: table %q: %w", path, t.name, err)
+		}
+		tableTypes[i] = types
+	}
+	if opts.Validate {
+		if err := validateFixtures(tables, tableTypes); err != nil {
+			return fmt.Errorf("cannot load fixtures from %s: %w", path, err)
+		}
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultFixtureBatchSize
+	}
+	for ti, t := range tables {
+		types := tableTypes[ti]
+		for start := 0; start < len(t.rows); {
+			columns := rowColumns(t.rows[start])
+			end := start + 1
+			for end < len(t.rows) && end-start < batchSize &&
+				(end-start+1)*len(columns) <= maxParams &&
+				equalStrings(rowColumns(t.rows[end]), columns) {
+				end++
+			}
+			if err := insertRows(tx, t.name, columns, t.rows[start:end], types); err != nil {
+				if end-start == 1 {
+					return fmt.Errorf("cannot load fixtures from %s: table %q row %d: %w", path, t.name, start, err)
+				}
+				return fmt.Errorf("cannot load fixtures from %s: table %q rows %d-%d: %w", path, t.name, start, end-1, err)
+			}
+			start = end
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("cannot load fixtures from %s: %w", path, err)
+	}
+	return nil
+}
+
+// validateFixtures checks that all the tables and columns used in
+// the given fixtures exist, where types holds the column types
+// for each table as returned by columnTypes. All mismatches are
+// included in the returned error.
+func validateFixtures(tables []fixtureTable, types []map[string]string) error {
+	var problems []string
+	for i, t := range tables {
+		if len(types[i]) == 0 {
+			problems = append(problems, fmt.Sprintf("table %q does not exist", t.name))
+			continue
+		}
+		missing := make(map[string]bool)
+		for _, row := range t.rows {
+			for column := range row {
+				if _, ok := types[i][column]; !ok {
+					missing[column] = true
+				}
+			}
+		}
+		columns := make([]string, 0, len(missing))
+		for column := range missing {
+			columns = append(columns, column)
+		}
+		sort.Strings(columns)
+		for _, column := range columns {
+			problems = append(problems, fmt.Sprintf("table %q has no column %q", t.name, column))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("fixtures do not match schema: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// columnTypes returns the data types of the columns in the given
+// table, keyed by column name.
+func columnTypes(tx *sql.Tx, schema, table string) (map[string]string, error) {
+	rows, err := tx.Query(`
+		SELECT column_name, data_type
+		FROM information_schema.columns
+		WHERE table_schema = $1 AND table_name = $2`, schema, table)
+	if err != nil {
+		return nil, fmt.Errorf("cannot query column types: %w", err)
+	}
+	defer rows.Close()
+	types := make(map[string]string)
+	for rows.Next() {
+		var name, dataType string
+		if err := rows.Scan(&name, &dataType); err != nil {
+			return nil, fmt.Errorf("cannot scan column types: %w", err)
+		}
+		types[name] = dataType
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot query column types: %w", err)
+	}
+	return types, nil
+}
+
+// rowColumns returns the sorted column names of the given row.
+func rowColumns(row map[string]interface{}) []string {
+	columns := make([]string, 0, len(row))
+	for column := range row {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	return columns
+}
+
+// insertRows inserts the given rows, all of which hold values for
+// exactly the given columns, into the given table with a single
+// statement, converting the values according to the given column
+// types.
+func insertRows(tx *sql.Tx, table string, columns []string, rows []map[string]interface{}, types map[string]string) error {
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = pq.QuoteIdentifier(column)
+	}
+	values := make([]string, len(rows))
+	args := make([]interface{}, 0, len(rows)*len(columns))
+	for i, row := range rows {
+		params := make([]string, len(columns))
+		for j, column := range columns {
+			v, err := fixtureValue(row[column], types[column])
+			if err != nil {
+				return fmt.Errorf("invalid value for column %q: %w", column, err)
+			}
+			args = append(args, v)
+			params[j] = fmt.Sprintf("$%d", len(args))
+		}
+		values[i] = "(" + strings.Join(params, ", ") + ")"
+	}
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES %s",
+		pq.QuoteIdentifier(table),
+		strings.Join(quoted, ", "),
+		strings.Join(values, ", "),
+	)
+	if _, err := tx.Exec(query, args...); err != nil {
+		return err
+	}
+	return nil
+}
+
+// fixtureValue converts a value read from a fixtures file into one
+// suitable for inserting into a column with the given data type.
+func fixtureValue(v interface{}, dataType string) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	switch dataType {
+	case "json", "jsonb":
+		if _, ok := v.(string); ok {
+			return v, nil
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		return string(data), nil
+	case "ARRAY":
+		if a, ok := v.([]interface{}); ok {
+			return pq.Array(a), nil
+		}
+	}
+	return v, nil
+}
+
+// normalizeYAML converts the generic maps produced by the YAML
+// decoder into maps keyed by string so that they can be encoded
+// as JSON.
+func normalizeYAML(v interface{}) interface{} {
+	switch v := v.(type) {
+	case yaml.MapSlice:
+		m := make(map[string]interface{}, len(v))
+		for _, item := range v {
+			m[fmt.Sprint(item.Key)] = normalizeYAML(item.Value)
+		}
+		return m
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			m[fmt.Sprint(key)] = normalizeYAML(val)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i, val := range v {
+			a[i] = normalizeYAML(val)
+		}
+		return a
+	}
+	return v
+}
@@ -0,0 +1,196 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest_test
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/postgrestest"
+	"github.com/lib/pq"
+)
+
+const fixtureSchema = `
+	CREATE TABLE users (id integer PRIMARY KEY, name text);
+	CREATE TABLE orders (
+		id integer PRIMARY KEY,
+		user_id integer REFERENCES users (id),
+		items text[],
+		details jsonb
+	);
+`
+
+var loadFixturesTests = []struct {
+	about string
+	file  string
+	data  string
+	load  func(db *postgrestest.DB, path string, opts *postgrestest.FixtureOptions) error
+}{{
+	about: "yaml",
+	file:  "fixtures.yaml",
+	data: `
+users:
+- id: 1
+  name: alice
+orders:
+- id: 10
+  user_id: 1
+  items: [apple, pear]
+  details: {rush: true}
+`,
+	load: (*postgrestest.DB).LoadFixturesYAML,
+}, {
+	about: "json",
+	file:  "fixtures.json",
+	data: `{
+	"users": [{"id": 1, "name": "alice"}],
+	"orders": [{"id": 10, "user_id": 1, "items": ["apple", "pear"], "details": {"rush": true}}]
+}`,
+	load: (*postgrestest.DB).LoadFixturesJSON,
+}}
+
+func TestLoadFixtures(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	for _, test := range loadFixturesTests {
+		c.Run(test.about, func(c *qt.C) {
+			db, err := postgrestest.New()
+			c.Assert(err, qt.Equals, nil)
+			defer db.Close()
+			_, err = db.Exec(fixtureSchema)
+			c.Assert(err, qt.Equals, nil)
+
+			path := filepath.Join(c.Mkdir(), test.file)
+			err = ioutil.WriteFile(path, []byte(test.data), 0666)
+			c.Assert(err, qt.Equals, nil)
+			err = test.load(db, path, nil)
+			c.Assert(err, qt.Equals, nil)
+
+			var name, items, details string
+			err = db.QueryRow(`
+				SELECT users.name, orders.items::text, orders.details::text
+				FROM orders JOIN users ON users.id = orders.user_id
+				WHERE orders.id = 10`).Scan(&name, &items, &details)
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(name, qt.Equals, "alice")
+			c.Assert(items, qt.Equals, "{apple,pear}")
+			c.Assert(details, qt.Equals, `{"rush": true}`)
+		})
+	}
+}
+
+func TestLoadFixturesError(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	db, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+	_, err = db.Exec(fixtureSchema)
+	c.Assert(err, qt.Equals, nil)
+
+	path := filepath.Join(c.Mkdir(), "fixtures.yaml")
+	err = ioutil.WriteFile(path, []byte("users:\n- id: 1\n- id: 1\n"), 0666)
+	c.Assert(err, qt.Equals, nil)
+	err = db.LoadFixturesYAML(path, nil)
+	c.Assert(err, qt.ErrorMatches, `cannot load fixtures from .*fixtures.yaml: table "users" rows 0-1: .*duplicate key.*`)
+
+	// With a batch size of one, the failing row is identified exactly.
+	err = db.LoadFixturesYAML(path, &postgrestest.FixtureOptions{
+		BatchSize: 1,
+	})
+	c.Assert(err, qt.ErrorMatches, `cannot load fixtures from .*fixtures.yaml: table "users" row 1: .*duplicate key.*`)
+	var pqErr *pq.Error
+	c.Assert(errors.As(err, &pqErr), qt.Equals, true)
+	c.Assert(pqErr.Code.Name(), qt.Equals, "unique_violation")
+
+	var count int
+	err = db.QueryRow(`SELECT COUNT(*) FROM users`).Scan(&count)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(count, qt.Equals, 0)
+}
+
+func TestLoadFixturesValidate(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	db, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+	_, err = db.Exec(fixtureSchema)
+	c.Assert(err, qt.Equals, nil)
+
+	path := filepath.Join(c.Mkdir(), "fixtures.yaml")
+	err = ioutil.WriteFile(path, []byte(`
+users:
+- id: 1
+  fullname: alice
+  email: alice@example.com
+products:
+- id: 1
+`), 0666)
+	c.Assert(err, qt.Equals, nil)
+	err = db.LoadFixturesYAML(path, &postgrestest.FixtureOptions{
+		Validate: true,
+	})
+	c.Assert(err, qt.ErrorMatches, `cannot load fixtures from .*fixtures.yaml: fixtures do not match schema: table "users" has no column "email"; table "users" has no column "fullname"; table "products" does not exist`)
+}
+
+func TestWithTriggersDisabled(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+	skipUnlessSuperuser(c, db)
+	_, err = db.Exec(fixtureSchema)
+	c.Assert(err, qt.Equals, nil)
+
+	insertOrder := func() error {
+		_, err := db.Exec(`INSERT INTO orders (id, user_id) VALUES (10, 1)`)
+		return err
+	}
+	err = db.WithTriggersDisabled([]string{"orders"}, insertOrder)
+	c.Assert(err, qt.Equals, nil)
+
+	// The foreign key is enforced again afterwards.
+	_, err = db.Exec(`INSERT INTO orders (id, user_id) VALUES (11, 2)`)
+	c.Assert(err, qt.ErrorMatches, `.*violates foreign key constraint.*`)
+}
+
+func TestLoadFixturesBatchSize(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	db, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+	_, err = db.Exec(fixtureSchema)
+	c.Assert(err, qt.Equals, nil)
+
+	// Rows with different columns can't share a batch.
+	path := filepath.Join(c.Mkdir(), "fixtures.json")
+	var users []string
+	for i := 0; i < 25; i++ {
+		if i%10 == 0 {
+			users = append(users, fmt.Sprintf(`{"id": %d}`, i))
+		} else {
+			users = append(users, fmt.Sprintf(`{"id": %d, "name": "user%d"}`, i, i))
+		}
+	}
+	data := `{"users": [` + strings.Join(users, ", ") + `]}`
+	err = ioutil.WriteFile(path, []byte(data), 0666)
+	c.Assert(err, qt.Equals, nil)
+	err = db.LoadFixturesJSON(path, &postgrestest.FixtureOptions{
+		BatchSize: 4,
+	})
+	c.Assert(err, qt.Equals, nil)
+
+	var count, named int
+	err = db.QueryRow(`SELECT COUNT(*), COUNT(name) FROM users`).Scan(&count, &named)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(count, qt.Equals, 25)
+	c.Assert(named, qt.Equals, 22)
+}
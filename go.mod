@@ -1,9 +1,10 @@
 module github.com/juju/postgrestest
 
-go 1.11
+go 1.16
 
 require (
 	github.com/frankban/quicktest v1.1.0
 	github.com/lib/pq v1.0.0
-	gopkg.in/errgo.v1 v1.0.0
+	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,319 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+// SequenceValue returns the last value allocated from the named
+// sequence in the test schema. Unlike currval, it does not require
+// the sequence to have been used in the current session, and unlike
+// nextval it does not allocate a new value. If no value has been
+// allocated from the sequence yet, it returns zero.
+func (pg *DB) SequenceValue(name string) (int64, error) {
+	var (
+		value    int64
+		isCalled bool
+	)
+	err := pg.DB.QueryRow(fmt.Sprintf(`SELECT last_value, is_called FROM %s.%s`,
+		pq.QuoteIdentifier(pg.schema),
+		pq.QuoteIdentifier(name),
+	)).Scan(&value, &isCalled)
+	if err != nil {
+		return 0, fmt.Errorf("cannot get value of sequence %q: %w", name, err)
+	}
+	if !isCalled {
+		return 0, nil
+	}
+	return value, nil
+}
+
+// relationKinds maps pg_class.relkind values to human-readable
+// names for the kinds of relation checked by AssertOwnership.
+var relationKinds = map[string]string{
+	"r": "table",
+	"p": "table",
+	"S": "sequence",
+	"v": "view",
+	"m": "materialized view",
+}
+
+// AssertOwnership fails the test if any table, sequence or view in
+// the test schema is not owned by the role with the given name.
+// All mis-owned objects are reported.
+func (pg *DB) AssertOwnership(t testing.TB, expectedOwner string) {
+	t.Helper()
+	rows, err := pg.DB.Query(`
+		SELECT c.relname, c.relkind, r.rolname
+		FROM pg_class c
+		JOIN pg_roles r ON r.oid = c.relowner
+		WHERE c.relnamespace = $1::regnamespace
+		AND c.relkind IN ('r', 'p', 'S', 'v', 'm')
+		ORDER BY c.relname`, pg.schema)
+	if err != nil {
+		t.Fatalf("cannot query object owners: %v", err)
+	}
+	defer rows.Close()
+	var problems []string
+	for rows.Next() {
+		var name, kind, owner string
+		if err := rows.Scan(&name, &kind, &owner); err != nil {
+			t.Fatalf("cannot scan object owners: %v", err)
+		}
+		if owner != expectedOwner {
+			problems = append(problems, fmt.Sprintf("%s %q is owned by %q", relationKinds[kind], name, owner))
+		}
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("cannot query object owners: %v", err)
+	}
+	if len(problems) > 0 {
+		t.Errorf("objects not owned by %q:\n%s", expectedOwner, strings.Join(problems, "\n"))
+	}
+}
+
+// Function describes a function or procedure defined in the test
+// schema.
+type Function struct {
+	// Name holds the name of the function.
+	Name string
+	// Arguments holds the arguments of the function, as they
+	// would be written in a DROP FUNCTION statement, for
+	// example "a integer, b text".
+	Arguments string
+	// Result holds the return type of the function, for example
+	// "SETOF integer". It is empty for procedures.
+	Result string
+}
+
+// Functions returns all the functions and procedures defined in the
+// test schema, ordered by name and then arguments.
+func (pg *DB) Functions() ([]Function, error) {
+	rows, err := pg.DB.Query(`
+		SELECT proname,
+			pg_get_function_identity_arguments(oid),
+			COALESCE(pg_get_function_result(oid), '')
+		FROM pg_proc
+		WHERE pronamespace = $1::regnamespace
+		ORDER BY 1, 2`, pg.schema)
+	if err != nil {
+		return nil, fmt.Errorf("cannot query functions: %w", err)
+	}
+	defer rows.Close()
+	var fs []Function
+	for rows.Next() {
+		var f Function
+		if err := rows.Scan(&f.Name, &f.Arguments, &f.Result); err != nil {
+			return nil, fmt.Errorf("cannot scan functions: %w", err)
+		}
+		fs = append(fs, f)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot query functions: %w", err)
+	}
+	return fs, nil
+}
+
+// Index describes an index on a table in the test schema.
+type Index struct {
+	// Name holds the name of the index.
+	Name string
+	// Columns holds the key columns of the index in order. Index
+	// expressions are included as their SQL text.
+	Columns []string
+	// Unique holds whether the index is unique.
+	Unique bool
+	// Method holds the index access method, for example "btree"
+	// or "gin".
+	Method string
+}
+
+// Indexes returns all the indexes on the given table in the test
+// schema, ordered by name.
+func (pg *DB) Indexes(table string) ([]Index, error) {
+	var version int
+	if err := pg.DB.QueryRow(`SELECT current_setting('server_version_num')::integer`).Scan(&version); err != nil {
+		return nil, fmt.Errorf("cannot get server version: %w", err)
+	}
+	// Non-key (INCLUDE) columns were added in version 11, along with
+	// indnkeyatts to count the key columns. Before that, every
+	// column is a key column.
+	keyColumns := "ix.indnkeyatts"
+	if version < 110000 {
+		keyColumns = "ix.indnatts"
+	}
+	rows, err := pg.DB.Query(`
+		SELECT i.relname, ix.indisunique, am.amname,
+			ARRAY(
+				SELECT pg_get_indexdef(ix.indexrelid, k, true)
+				FROM generate_series(1, `+keyColumns+`) k
+				ORDER BY k
+			)
+		FROM pg_index ix
+		JOIN pg_class i ON i.oid = ix.indexrelid
+		JOIN pg_class t ON t.oid = ix.indrelid
+		JOIN pg_am am ON am.oid = i.relam
+		WHERE t.relnamespace = $1::regnamespace AND t.relname = $2
+		ORDER BY i.relname`, pg.schema, table)
+	if err != nil {
+		return nil, fmt.Errorf("cannot query indexes: %w", err)
+	}
+	defer rows.Close()
+	var indexes []Index
+	for rows.Next() {
+		var index Index
+		if err := rows.Scan(&index.Name, &index.Unique, &index.Method, (*pq.StringArray)(&index.Columns)); err != nil {
+			return nil, fmt.Errorf("cannot scan indexes: %w", err)
+		}
+		indexes = append(indexes, index)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot query indexes: %w", err)
+	}
+	return indexes, nil
+}
+
+// Tables returns the names of all the tables in the test schema in
+// alphabetical order.
+func (pg *DB) Tables() ([]string, error) {
+	rows, err := pg.DB.Query(`
+		SELECT table_name
+		FROM information_schema.tables
+		WHERE table_schema = $1 AND table_type = 'BASE TABLE'
+		ORDER BY 1`, pg.schema)
+	if err != nil {
+		return nil, fmt.Errorf("cannot query tables: %w", err)
+	}
+	defer rows.Close()
+	var tables []string
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			return nil, fmt.Errorf("cannot scan tables: %w", err)
+		}
+		tables = append(tables, table)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot query tables: %w", err)
+	}
+	return tables, nil
+}
+
+// AssertTables fails the test unless the test schema holds exactly
+// the tables named in want, in any order. Missing tables are
+// reported prefixed with "-" and unexpected tables with "+".
+func (pg *DB) AssertTables(t testing.TB, want []string) {
+	t.Helper()
+	got, err := pg.Tables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = append([]string(nil), want...)
+	sort.Strings(want)
+	sort.Strings(got)
+	if diff := diffLines(want, got); diff != "" {
+		t.Errorf("unexpected tables in schema (-want +got):\n%s", diff)
+	}
+}
+
+// SchemaSize returns the total disk space in bytes used by the
+// relations in the test schema, as reported by
+// pg_total_relation_size. This includes the space used by tables,
+// materialized views and sequences along with their indexes and
+// TOAST data.
+func (pg *DB) SchemaSize() (int64, error) {
+	var size int64
+	err := pg.DB.QueryRow(`
+		SELECT COALESCE(SUM(pg_total_relation_size(oid)), 0)::bigint
+		FROM pg_class
+		WHERE relnamespace = $1::regnamespace
+		AND relkind IN ('r', 'm', 'S')`, pg.schema).Scan(&size)
+	if err != nil {
+		return 0, fmt.Errorf("cannot get schema size: %w", err)
+	}
+	return size, nil
+}
+
+// AssertSchemaSizeUnder fails the test if the size of the test
+// schema as returned by SchemaSize is not less than budget bytes.
+func (pg *DB) AssertSchemaSizeUnder(t testing.TB, budget int64) {
+	t.Helper()
+	size, err := pg.SchemaSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size >= budget {
+		t.Errorf("schema size %d bytes exceeds budget of %d bytes", size, budget)
+	}
+}
+
+// EnumValues returns the labels of the named enum type in the test
+// schema, in their sort order.
+func (pg *DB) EnumValues(typeName string) ([]string, error) {
+	var (
+		oid     int64
+		typtype string
+	)
+	err := pg.DB.QueryRow(`
+		SELECT oid, typtype
+		FROM pg_type
+		WHERE typnamespace = $1::regnamespace AND typname = $2`, pg.schema, typeName).Scan(&oid, &typtype)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("type %q does not exist in schema %s", typeName, pg.schema)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot query type %q: %w", typeName, err)
+	}
+	if typtype != "e" {
+		return nil, fmt.Errorf("type %q is not an enum", typeName)
+	}
+	rows, err := pg.DB.Query(`
+		SELECT enumlabel
+		FROM pg_enum
+		WHERE enumtypid = $1
+		ORDER BY enumsortorder`, oid)
+	if err != nil {
+		return nil, fmt.Errorf("cannot query enum values: %w", err)
+	}
+	defer rows.Close()
+	values := []string{}
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, fmt.Errorf("cannot scan enum values: %w", err)
+		}
+		values = append(values, value)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot query enum values: %w", err)
+	}
+	return values, nil
+}
+
+// ColumnDefault returns the default expression of the given column
+// in the test schema, for example "now()". It returns the empty
+// string if the column has no default, and an error if the column
+// does not exist.
+func (pg *DB) ColumnDefault(table, column string) (string, error) {
+	var def sql.NullString
+	err := pg.DB.QueryRow(`
+		SELECT column_default
+		FROM information_schema.columns
+		WHERE table_schema = $1 AND table_name = $2 AND column_name = $3`,
+		pg.schema, table, column).Scan(&def)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("column %q of table %q does not exist", column, table)
+	}
+	if err != nil {
+		return "", fmt.Errorf("cannot query default of column %q: %w", column, err)
+	}
+	return def.String, nil
+}
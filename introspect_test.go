@@ -0,0 +1,243 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest_test
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/postgrestest"
+)
+
+func TestSequenceValue(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+
+	_, err = db.Exec(`CREATE TABLE x (id serial, val text)`)
+	c.Assert(err, qt.Equals, nil)
+	v, err := db.SequenceValue("x_id_seq")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(v, qt.Equals, int64(0))
+
+	_, err = db.Exec(`INSERT INTO x (val) VALUES ('a'), ('b'), ('c')`)
+	c.Assert(err, qt.Equals, nil)
+	v, err = db.SequenceValue("x_id_seq")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(v, qt.Equals, int64(3))
+
+	// Check that getting the value didn't allocate a new one.
+	v, err = db.SequenceValue("x_id_seq")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(v, qt.Equals, int64(3))
+
+	_, err = db.SequenceValue("nonexistent")
+	c.Assert(err, qt.ErrorMatches, `cannot get value of sequence "nonexistent": .*`)
+}
+
+func TestAssertOwnership(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+
+	_, err = db.Exec(`
+		CREATE TABLE x (id serial);
+		CREATE VIEW y AS SELECT id FROM x;
+	`)
+	c.Assert(err, qt.Equals, nil)
+	var user string
+	err = db.QueryRow(`SELECT current_user`).Scan(&user)
+	c.Assert(err, qt.Equals, nil)
+	db.AssertOwnership(t, user)
+
+	rt := &recordingTB{TB: t}
+	db.AssertOwnership(rt, "someone_else")
+	c.Assert(rt.errors, qt.DeepEquals, []string{
+		`objects not owned by "someone_else":` + "\n" +
+			`table "x" is owned by "` + user + `"` + "\n" +
+			`sequence "x_id_seq" is owned by "` + user + `"` + "\n" +
+			`view "y" is owned by "` + user + `"`,
+	})
+}
+
+func TestFunctions(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+
+	fs, err := db.Functions()
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(fs, qt.HasLen, 0)
+
+	_, err = db.Exec(`
+		CREATE FUNCTION add(a integer, b integer) RETURNS integer
+			AS 'SELECT a + b' LANGUAGE SQL;
+		CREATE FUNCTION add(a text, b text) RETURNS text
+			AS 'SELECT a || b' LANGUAGE SQL;
+		CREATE FUNCTION count_to(n integer) RETURNS SETOF integer
+			AS 'SELECT generate_series(1, n)' LANGUAGE SQL;
+	`)
+	c.Assert(err, qt.Equals, nil)
+	fs, err = db.Functions()
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(fs, qt.DeepEquals, []postgrestest.Function{{
+		Name:      "add",
+		Arguments: "a integer, b integer",
+		Result:    "integer",
+	}, {
+		Name:      "add",
+		Arguments: "a text, b text",
+		Result:    "text",
+	}, {
+		Name:      "count_to",
+		Arguments: "n integer",
+		Result:    "SETOF integer",
+	}})
+}
+
+func TestIndexes(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+
+	_, err = db.Exec(`
+		CREATE TABLE users (
+			id integer PRIMARY KEY,
+			tenant_id integer,
+			email text,
+			tags text[]
+		);
+		CREATE UNIQUE INDEX users_tenant_email ON users (tenant_id, email);
+		CREATE INDEX users_tags ON users USING gin (tags);
+		CREATE INDEX users_lower_email ON users (lower(email));
+	`)
+	c.Assert(err, qt.Equals, nil)
+	indexes, err := db.Indexes("users")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(indexes, qt.DeepEquals, []postgrestest.Index{{
+		Name:    "users_lower_email",
+		Columns: []string{"lower(email)"},
+		Method:  "btree",
+	}, {
+		Name:    "users_pkey",
+		Columns: []string{"id"},
+		Unique:  true,
+		Method:  "btree",
+	}, {
+		Name:    "users_tags",
+		Columns: []string{"tags"},
+		Method:  "gin",
+	}, {
+		Name:    "users_tenant_email",
+		Columns: []string{"tenant_id", "email"},
+		Unique:  true,
+		Method:  "btree",
+	}})
+}
+
+func TestAssertTables(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+
+	db.AssertTables(t, nil)
+	_, err = db.Exec(`
+		CREATE TABLE b (id integer);
+		CREATE TABLE a (id integer);
+		CREATE VIEW v AS SELECT id FROM a;
+	`)
+	c.Assert(err, qt.Equals, nil)
+	tables, err := db.Tables()
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(tables, qt.DeepEquals, []string{"a", "b"})
+	db.AssertTables(t, []string{"b", "a"})
+
+	rt := &recordingTB{TB: t}
+	db.AssertTables(rt, []string{"a", "c"})
+	c.Assert(rt.errors, qt.DeepEquals, []string{
+		"unexpected tables in schema (-want +got):\n-c\n+b",
+	})
+}
+
+func TestSchemaSize(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+
+	size, err := db.SchemaSize()
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(size, qt.Equals, int64(0))
+
+	_, err = db.Exec(`
+		CREATE TABLE x (id integer PRIMARY KEY, val text);
+		INSERT INTO x SELECT n, repeat('x', 100) FROM generate_series(1, 1000) n;
+	`)
+	c.Assert(err, qt.Equals, nil)
+	size, err = db.SchemaSize()
+	c.Assert(err, qt.Equals, nil)
+	var want int64
+	err = db.QueryRow(`SELECT pg_total_relation_size('x')`).Scan(&want)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(size, qt.Equals, want)
+
+	db.AssertSchemaSizeUnder(t, size+1)
+	rt := &recordingTB{TB: t}
+	db.AssertSchemaSizeUnder(rt, size)
+	c.Assert(rt.errors, qt.HasLen, 1)
+}
+
+func TestEnumValues(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+
+	_, err = db.Exec(`
+		CREATE TYPE status AS ENUM ('pending', 'done');
+		ALTER TYPE status ADD VALUE 'running' BEFORE 'done';
+		CREATE DOMAIN positive AS integer CHECK (VALUE > 0);
+	`)
+	c.Assert(err, qt.Equals, nil)
+	values, err := db.EnumValues("status")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(values, qt.DeepEquals, []string{"pending", "running", "done"})
+
+	_, err = db.EnumValues("positive")
+	c.Assert(err, qt.ErrorMatches, `type "positive" is not an enum`)
+	_, err = db.EnumValues("nonexistent")
+	c.Assert(err, qt.ErrorMatches, `type "nonexistent" does not exist in schema go_test_.*`)
+}
+
+func TestColumnDefault(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+
+	_, err = db.Exec(`
+		CREATE TABLE x (
+			id integer,
+			state text DEFAULT 'new',
+			created_at timestamp with time zone DEFAULT now()
+		)
+	`)
+	c.Assert(err, qt.Equals, nil)
+	def, err := db.ColumnDefault("x", "created_at")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(def, qt.Equals, "now()")
+	def, err = db.ColumnDefault("x", "state")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(def, qt.Equals, "'new'::text")
+	def, err = db.ColumnDefault("x", "id")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(def, qt.Equals, "")
+	_, err = db.ColumnDefault("x", "nonexistent")
+	c.Assert(err, qt.ErrorMatches, `column "nonexistent" of table "x" does not exist`)
+}
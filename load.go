@@ -0,0 +1,250 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// gzipMagic holds the first bytes of any gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// copyPattern matches the first line of a COPY statement whose data
+// follows on the next lines, as written by pg_dump.
+var copyPattern = regexp.MustCompile(`(?i)^COPY\s.*\sFROM\s+stdin;\s*$`)
+
+// clearSearchPathPattern matches the statement with which pg_dump
+// clears the search path.
+var clearSearchPathPattern = regexp.MustCompile(`(?i)^SELECT\s+pg_catalog\.set_config\('search_path',\s*'',\s*false\);\s*$`)
+
+// LoadSQL executes all the SQL statements read from r in the test
+// schema, in a single transaction. If the data is gzip-compressed, as
+// produced by "pg_dump | gzip", it is decompressed first. Compression
+// is detected from the content, so no file extension is needed.
+//
+// Output from pg_dump in plain format is supported: the data of each
+// COPY ... FROM stdin statement is read from the lines that follow it,
+// and the statement that clears the search path is skipped so that
+// the rest of the script still runs in the test schema. Note that
+// pg_dump qualifies names with the schema they were dumped from, so
+// such objects are created in that schema rather than the test
+// schema.
+//
+// The decompressed SQL is held in memory while it is executed, but
+// is never written to disk.
+func (pg *DB) LoadSQL(r io.Reader) error {
+	data, err := readMaybeGzipped(r)
+	if err != nil {
+		return err
+	}
+	tx, err := pg.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("cannot start transaction: %w", err)
+	}
+	defer tx.Rollback()
+	if err := loadScript(tx, string(data)); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("cannot commit SQL: %w", err)
+	}
+	return nil
+}
+
+// loadScript executes the given SQL script in tx, feeding the data of
+// any COPY ... FROM stdin statements to the server.
+func loadScript(tx *sql.Tx, script string) error {
+	lines := strings.SplitAfter(script, "\n")
+	var stmts strings.Builder
+	flush := func() error {
+		text := stmts.String()
+		stmts.Reset()
+		if strings.TrimSpace(text) == "" {
+			return nil
+		}
+		if _, err := tx.Exec(text); err != nil {
+			return fmt.Errorf("cannot execute SQL: %w", err)
+		}
+		return nil
+	}
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimRight(lines[i], "\r\n")
+		switch {
+		case clearSearchPathPattern.MatchString(line):
+			// Keep the search path set to the test schema.
+		case copyPattern.MatchString(line):
+			if err := flush(); err != nil {
+				return err
+			}
+			n, err := copyIn(tx, line, lines[i+1:])
+			if err != nil {
+				return fmt.Errorf("cannot copy data at line %d: %w", i+1, err)
+			}
+			i += n
+		default:
+			stmts.WriteString(lines[i])
+		}
+	}
+	return flush()
+}
+
+// copyIn executes the given COPY statement, reading its data in text
+// format from lines up to the terminating "\." line. It returns the
+// number of lines read.
+func copyIn(tx *sql.Tx, stmt string, lines []string) (int, error) {
+	ci, err := tx.Prepare(stmt)
+	if err != nil {
+		return 0, err
+	}
+	defer ci.Close()
+	for i, line := range lines {
+		line = strings.TrimRight(line, "\r\n")
+		if line == `\.` {
+			if _, err := ci.Exec(); err != nil {
+				return 0, err
+			}
+			return i + 1, nil
+		}
+		if _, err := ci.Exec(copyFields(line)...); err != nil {
+			return 0, err
+		}
+	}
+	return 0, errors.New("missing end of data marker")
+}
+
+// copyFields returns the values held in a row of COPY data in text
+// format.
+func copyFields(line string) []interface{} {
+	fields := strings.Split(line, "\t")
+	values := make([]interface{}, len(fields))
+	for i, field := range fields {
+		if field == `\N` {
+			values[i] = nil
+		} else {
+			values[i] = unescapeCopy(field)
+		}
+	}
+	return values
+}
+
+// copyEscapes maps the characters that follow a backslash in COPY
+// data to the characters they stand for.
+var copyEscapes = map[byte]byte{
+	'b': '\b',
+	'f': '\f',
+	'n': '\n',
+	'r': '\r',
+	't': '\t',
+	'v': '\v',
+}
+
+// unescapeCopy interprets the backslash escapes in a field of COPY
+// data in text format.
+func unescapeCopy(field string) string {
+	if !strings.Contains(field, `\`) {
+		return field
+	}
+	var b strings.Builder
+	for i := 0; i < len(field); i++ {
+		c := field[i]
+		if c != '\\' || i+1 == len(field) {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		c = field[i]
+		switch {
+		case copyEscapes[c] != 0:
+			b.WriteByte(copyEscapes[c])
+		case c >= '0' && c <= '7':
+			// Up to three octal digits.
+			n := 0
+			for j := 0; j < 3 && i < len(field) && field[i] >= '0' && field[i] <= '7'; j++ {
+				n = n*8 + int(field[i]-'0')
+				i++
+			}
+			i--
+			b.WriteByte(byte(n))
+		case c == 'x' && i+1 < len(field) && isHexDigit(field[i+1]):
+			// One or two hex digits.
+			n := 0
+			for j := 0; j < 2 && i+1 < len(field) && isHexDigit(field[i+1]); j++ {
+				i++
+				d, _ := strconv.ParseUint(field[i:i+1], 16, 8)
+				n = n*16 + int(d)
+			}
+			b.WriteByte(byte(n))
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func isHexDigit(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+// LoadSQLFile is like LoadSQL except that the SQL is read from the
+// file at the given path, which may be gzip-compressed
+// (for example "base.sql.gz").
+func (pg *DB) LoadSQLFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("cannot open SQL file: %w", err)
+	}
+	defer f.Close()
+	if err := pg.LoadSQL(f); err != nil {
+		return fmt.Errorf("cannot load %s: %w", path, err)
+	}
+	return nil
+}
+
+// readFileMaybeGzipped returns the contents of the file at the
+// given path, decompressing it if it is gzip-compressed.
+func readFileMaybeGzipped(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readMaybeGzipped(f)
+}
+
+// readMaybeGzipped reads all the data from r, decompressing it
+// if it starts with the gzip magic number.
+func readMaybeGzipped(r io.Reader) ([]byte, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(gzipMagic))
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("cannot read data: %w", err)
+	}
+	if !bytes.Equal(magic, gzipMagic) {
+		data, err := ioutil.ReadAll(br)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read data: %w", err)
+		}
+		return data, nil
+	}
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decompress data: %w", err)
+	}
+	data, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decompress data: %w", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,166 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/postgrestest"
+)
+
+const loadSQL = `
+	CREATE TABLE x (id integer, val text);
+	INSERT INTO x VALUES (1, 'a'), (2, 'b');
+`
+
+func gzipped(c *qt.C, s string) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write([]byte(s))
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(w.Close(), qt.Equals, nil)
+	return buf.Bytes()
+}
+
+func TestLoadSQL(t *testing.T) {
+	c := qt.New(t)
+	for _, compress := range []bool{false, true} {
+		db, err := postgrestest.New()
+		c.Assert(err, qt.Equals, nil)
+		data := []byte(loadSQL)
+		if compress {
+			data = gzipped(c, loadSQL)
+		}
+		err = db.LoadSQL(bytes.NewReader(data))
+		c.Assert(err, qt.Equals, nil)
+		db.AssertTables(t, []string{"x"})
+		c.Assert(db.Close(), qt.Equals, nil)
+	}
+}
+
+func TestLoadSQLFile(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	db, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+
+	path := filepath.Join(c.Mkdir(), "base.sql.gz")
+	err = ioutil.WriteFile(path, gzipped(c, loadSQL), 0666)
+	c.Assert(err, qt.Equals, nil)
+	err = db.LoadSQLFile(path)
+	c.Assert(err, qt.Equals, nil)
+	var count int
+	err = db.QueryRow(`SELECT COUNT(*) FROM x`).Scan(&count)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(count, qt.Equals, 2)
+}
+
+// dumpSQL holds SQL in the form written by pg_dump.
+const dumpSQL = `
+SET statement_timeout = 0;
+SELECT pg_catalog.set_config('search_path', '', false);
+SET standard_conforming_strings = on;
+
+CREATE TABLE x (id integer, val text);
+
+COPY x (id, val) FROM stdin;
+1	a\tb
+2	\N
+\.
+
+CREATE INDEX x_id ON x (id);
+`
+
+func TestLoadSQLCopy(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+	// Use a single connection so that a change to the search path
+	// would be seen.
+	db.SetMaxOpenConns(1)
+
+	err = db.LoadSQL(strings.NewReader(dumpSQL))
+	c.Assert(err, qt.Equals, nil)
+	var schema string
+	err = db.QueryRow(`SELECT current_schema()`).Scan(&schema)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(schema, qt.Equals, db.Schema())
+	var vals []*string
+	err = db.Stream(context.Background(), `SELECT val FROM x ORDER BY id`, func(rows *sql.Rows) error {
+		var val *string
+		if err := rows.Scan(&val); err != nil {
+			return err
+		}
+		vals = append(vals, val)
+		return nil
+	})
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(vals, qt.HasLen, 2)
+	c.Assert(*vals[0], qt.Equals, "a\tb")
+	c.Assert(vals[1], qt.IsNil)
+
+	err = db.LoadSQL(strings.NewReader("COPY x (id, val) FROM stdin;\n3\tc\n"))
+	c.Assert(err, qt.ErrorMatches, `cannot copy data at line 1: missing end of data marker`)
+}
+
+func TestLoadSQLPgDump(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	if _, err := exec.LookPath("pg_dump"); err != nil {
+		c.Skip("pg_dump not available")
+	}
+	src, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	_, err = src.Exec(`
+		CREATE TABLE x (id integer PRIMARY KEY, val text);
+		INSERT INTO x VALUES (1, 'a'), (2, E'tab\there'), (3, NULL);
+	`)
+	c.Assert(err, qt.Equals, nil)
+	path := filepath.Join(c.Mkdir(), "dump.sql.gz")
+	c.Assert(src.DumpToFile(path), qt.Equals, nil)
+	schema := src.Schema()
+	c.Assert(src.Close(), qt.Equals, nil)
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, qt.Equals, nil)
+	err = ioutil.WriteFile(path, gzipped(c, string(data)), 0666)
+	c.Assert(err, qt.Equals, nil)
+
+	// The dump recreates the schema it was taken from.
+	db, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+	defer db.Exec(`DROP SCHEMA ` + schema + ` CASCADE`)
+	err = db.LoadSQLFile(path)
+	c.Assert(err, qt.Equals, nil)
+	var n int
+	err = db.QueryRow(`SELECT COUNT(*) FROM ` + schema + `.x WHERE val = E'tab\there'`).Scan(&n)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(n, qt.Equals, 1)
+}
+
+func TestLoadSQLErrors(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+
+	truncated := gzipped(c, loadSQL)
+	truncated = truncated[:len(truncated)/2]
+	err = db.LoadSQL(bytes.NewReader(truncated))
+	c.Assert(err, qt.ErrorMatches, `cannot decompress data: .*`)
+
+	err = db.LoadSQL(strings.NewReader(`CREATE TABLE`))
+	c.Assert(err, qt.ErrorMatches, `cannot execute SQL: .*syntax error.*`)
+}
@@ -0,0 +1,362 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Statement holds a statement executed through a DB created with
+// WithLogger or with PGTESTLOG set.
+type Statement struct {
+	// Query holds the SQL text of the statement.
+	Query string
+	// Args holds the arguments to the statement.
+	Args []interface{}
+	// Duration holds the time taken to execute the statement. For
+	// queries, this does not include the time taken to read the
+	// rows.
+	Duration time.Duration
+	// Err holds any error returned.
+	Err error
+}
+
+// String returns a one-line description of the statement.
+func (s Statement) String() string {
+	str := fmt.Sprintf("%s %v (%v)", s.Query, s.Args, s.Duration)
+	if s.Err != nil {
+		str += ": " + s.Err.Error()
+	}
+	return str
+}
+
+// Statements returns the statements executed through pg so far, in
+// order, including any run by the package itself such as the CREATE
+// SCHEMA statement. It returns nil unless pg was created with
+// WithLogger or with the PGTESTLOG environment variable set.
+func (pg *DB) Statements() []Statement {
+	if pg.log == nil {
+		return nil
+	}
+	pg.log.mu.Lock()
+	defer pg.log.mu.Unlock()
+	return append([]Statement(nil), pg.log.statements...)
+}
+
+// QueryCount returns the number of statements executed through pg
+// since it was returned by New or NewWithOptions, or since the last
+// call to ResetQueryCount. This can be used to check that a code path
+// makes no more round trips than expected, for example to catch N+1
+// query patterns. The count is taken at the database/sql driver
+// layer, so BEGIN, COMMIT and ROLLBACK each count as a statement;
+// schema setup done by NewWithOptions is not counted.
+//
+// Statements are only recorded by a DB created with WithQueryCount,
+// WithLogger or WithSlowQueryThreshold, or with PGTESTLOG set.
+// QueryCount panics otherwise, so that a check on the count cannot
+// pass by mistake.
+func (pg *DB) QueryCount() int {
+	if pg.log == nil {
+		panic("postgrestest: QueryCount called on a DB that does not record statements; use WithQueryCount")
+	}
+	pg.log.mu.Lock()
+	defer pg.log.mu.Unlock()
+	return len(pg.log.statements) - pg.log.countFrom
+}
+
+// ResetQueryCount resets the count returned by QueryCount to zero.
+func (pg *DB) ResetQueryCount() {
+	if pg.log == nil {
+		return
+	}
+	pg.log.mu.Lock()
+	defer pg.log.mu.Unlock()
+	pg.log.countFrom = len(pg.log.statements)
+}
+
+// statementLog records statements.
+type statementLog struct {
+	// logf, if non-nil, is called for each statement.
+	logf func(query string, args []interface{}, d time.Duration, err error)
+
+	// slowThreshold, if non-zero, restricts logging to statements
+	// that take longer than this.
+	slowThreshold time.Duration
+
+	mu         sync.Mutex
+	statements []Statement
+	// countFrom holds the number of statements recorded when the
+	// query count was last reset.
+	countFrom int
+}
+
+func (l *statementLog) record(query string, args []driver.NamedValue, start time.Time, err error) {
+	if err == driver.ErrSkip {
+		// database/sql will try again another way.
+		return
+	}
+	s := Statement{
+		Query:    query,
+		Duration: time.Since(start),
+		Err:      err,
+	}
+	for _, arg := range args {
+		s.Args = append(s.Args, arg.Value)
+	}
+	l.mu.Lock()
+	l.statements = append(l.statements, s)
+	l.mu.Unlock()
+	switch {
+	case l.slowThreshold > 0 && s.Duration <= l.slowThreshold:
+	case l.logf != nil:
+		l.logf(s.Query, s.Args, s.Duration, s.Err)
+	case l.slowThreshold > 0:
+		fmt.Fprintf(os.Stderr, "postgrestest: slow statement: %v\n", s)
+	}
+}
+
+// openLogged is like sql.Open except that every statement executed
+// using the returned DB is recorded in log.
+func openLogged(driverName, dataSource string, log *statementLog) (*sql.DB, error) {
+	// sql.Open does not connect, so this is a cheap way of finding
+	// the driver.
+	db, err := sql.Open(driverName, dataSource)
+	if err != nil {
+		return nil, err
+	}
+	d := db.Driver()
+	db.Close()
+	var c driver.Connector
+	if dc, ok := d.(driver.DriverContext); ok {
+		c, err = dc.OpenConnector(dataSource)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		c = dsnConnector{driver: d, dataSource: dataSource}
+	}
+	return sql.OpenDB(loggingConnector{Connector: c, log: log}), nil
+}
+
+// dsnConnector implements driver.Connector for drivers that do not
+// implement driver.DriverContext.
+type dsnConnector struct {
+	driver     driver.Driver
+	dataSource string
+}
+
+func (c dsnConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dataSource)
+}
+
+func (c dsnConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// loggingConnector wraps the connections made by a connector so that
+// statements are recorded.
+type loggingConnector struct {
+	driver.Connector
+	log *statementLog
+}
+
+func (c loggingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &loggingConn{conn: conn, log: c.log}, nil
+}
+
+// loggingConn records the statements executed on a connection. It
+// delegates the optional driver interfaces to the underlying
+// connection, returning driver.ErrSkip where that is allowed if the
+// connection does not implement them.
+type loggingConn struct {
+	conn driver.Conn
+	log  *statementLog
+}
+
+func (c *loggingConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *loggingConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var stmt driver.Stmt
+	var err error
+	if pc, ok := c.conn.(driver.ConnPrepareContext); ok {
+		stmt, err = pc.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &loggingStmt{stmt: stmt, query: query, log: c.log}, nil
+}
+
+func (c *loggingConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *loggingConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *loggingConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	start := time.Now()
+	var tx driver.Tx
+	var err error
+	if bc, ok := c.conn.(driver.ConnBeginTx); ok {
+		tx, err = bc.BeginTx(ctx, opts)
+	} else {
+		tx, err = c.conn.Begin()
+	}
+	c.log.record("BEGIN", nil, start, err)
+	if err != nil {
+		return nil, err
+	}
+	return loggingTx{tx: tx, log: c.log}, nil
+}
+
+func (c *loggingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	ec, ok := c.conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	result, err := ec.ExecContext(ctx, query, args)
+	c.log.record(query, args, start, err)
+	return result, err
+}
+
+func (c *loggingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	qc, ok := c.conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	rows, err := qc.QueryContext(ctx, query, args)
+	c.log.record(query, args, start, err)
+	return rows, err
+}
+
+func (c *loggingConn) Ping(ctx context.Context) error {
+	if p, ok := c.conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *loggingConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *loggingConn) CheckNamedValue(v *driver.NamedValue) error {
+	if nc, ok := c.conn.(driver.NamedValueChecker); ok {
+		return nc.CheckNamedValue(v)
+	}
+	return driver.ErrSkip
+}
+
+// loggingTx records the end of a transaction.
+type loggingTx struct {
+	tx  driver.Tx
+	log *statementLog
+}
+
+func (tx loggingTx) Commit() error {
+	start := time.Now()
+	err := tx.tx.Commit()
+	tx.log.record("COMMIT", nil, start, err)
+	return err
+}
+
+func (tx loggingTx) Rollback() error {
+	start := time.Now()
+	err := tx.tx.Rollback()
+	tx.log.record("ROLLBACK", nil, start, err)
+	return err
+}
+
+// loggingStmt records the executions of a prepared statement.
+type loggingStmt struct {
+	stmt  driver.Stmt
+	query string
+	log   *statementLog
+}
+
+func (s *loggingStmt) Close() error {
+	return s.stmt.Close()
+}
+
+func (s *loggingStmt) NumInput() int {
+	return s.stmt.NumInput()
+}
+
+func (s *loggingStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.ExecContext(context.Background(), namedValues(args))
+}
+
+func (s *loggingStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.QueryContext(context.Background(), namedValues(args))
+}
+
+func (s *loggingStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	var result driver.Result
+	var err error
+	if ec, ok := s.stmt.(driver.StmtExecContext); ok {
+		result, err = ec.ExecContext(ctx, args)
+	} else {
+		result, err = s.stmt.Exec(values(args))
+	}
+	s.log.record(s.query, args, start, err)
+	return result, err
+}
+
+func (s *loggingStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	var rows driver.Rows
+	var err error
+	if qc, ok := s.stmt.(driver.StmtQueryContext); ok {
+		rows, err = qc.QueryContext(ctx, args)
+	} else {
+		rows, err = s.stmt.Query(values(args))
+	}
+	s.log.record(s.query, args, start, err)
+	return rows, err
+}
+
+func (s *loggingStmt) CheckNamedValue(v *driver.NamedValue) error {
+	if nc, ok := s.stmt.(driver.NamedValueChecker); ok {
+		return nc.CheckNamedValue(v)
+	}
+	return driver.ErrSkip
+}
+
+func namedValues(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(args))
+	for i, arg := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: arg}
+	}
+	return named
+}
+
+func values(args []driver.NamedValue) []driver.Value {
+	vals := make([]driver.Value, len(args))
+	for i, arg := range args {
+		vals[i] = arg.Value
+	}
+	return vals
+}
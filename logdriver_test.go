@@ -0,0 +1,104 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest_test
+
+import (
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/postgrestest"
+)
+
+func TestWithLogger(t *testing.T) {
+	c := qt.New(t)
+	var logged []string
+	db, err := postgrestest.NewWithOptions(postgrestest.WithLogger(func(query string, args []interface{}, d time.Duration, err error) {
+		logged = append(logged, query)
+	}))
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+
+	_, err = db.Exec(`CREATE TABLE x (id integer)`)
+	c.Assert(err, qt.Equals, nil)
+	tx, err := db.Begin()
+	c.Assert(err, qt.Equals, nil)
+	_, err = tx.Exec(`INSERT INTO x VALUES ($1)`, 42)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(tx.Commit(), qt.Equals, nil)
+	_, err = db.Exec(`SELECT * FROM nosuchtable`)
+	c.Assert(err, qt.Not(qt.IsNil))
+
+	stmts := db.Statements()
+	// The first statement creates the schema.
+	c.Assert(stmts[0].Query, qt.Matches, `CREATE SCHEMA .*`)
+	stmts = stmts[1:]
+	c.Assert(stmts, qt.HasLen, 5)
+	c.Assert(stmts[0].Query, qt.Equals, `CREATE TABLE x (id integer)`)
+	c.Assert(stmts[1].Query, qt.Equals, `BEGIN`)
+	c.Assert(stmts[2].Query, qt.Equals, `INSERT INTO x VALUES ($1)`)
+	c.Assert(stmts[2].Args, qt.DeepEquals, []interface{}{int64(42)})
+	c.Assert(stmts[3].Query, qt.Equals, `COMMIT`)
+	c.Assert(stmts[4].Err, qt.ErrorMatches, `.*"nosuchtable" does not exist`)
+	c.Assert(logged, qt.HasLen, 6)
+}
+
+func TestWithSlowQueryThreshold(t *testing.T) {
+	c := qt.New(t)
+	var logged []string
+	db, err := postgrestest.NewWithOptions(
+		postgrestest.WithSlowQueryThreshold(100*time.Millisecond),
+		postgrestest.WithLogger(func(query string, args []interface{}, d time.Duration, err error) {
+			logged = append(logged, query)
+		}),
+	)
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+
+	_, err = db.Exec(`SELECT 1`)
+	c.Assert(err, qt.Equals, nil)
+	_, err = db.Exec(`SELECT pg_sleep(0.2)`)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(logged, qt.DeepEquals, []string{`SELECT pg_sleep(0.2)`})
+	// All the statements are still recorded.
+	c.Assert(db.Statements(), qt.HasLen, 3)
+}
+
+func TestQueryCount(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.NewWithOptions(
+		postgrestest.WithQueryCount(),
+		postgrestest.WithSchemaSQL(`CREATE TABLE x (id integer)`),
+	)
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+
+	// Setting up the schema is not counted.
+	c.Assert(db.QueryCount(), qt.Equals, 0)
+	for i := 0; i < 3; i++ {
+		_, err := db.Exec(`INSERT INTO x VALUES ($1)`, i)
+		c.Assert(err, qt.Equals, nil)
+	}
+	c.Assert(db.QueryCount(), qt.Equals, 3)
+	db.ResetQueryCount()
+	tx, err := db.Begin()
+	c.Assert(err, qt.Equals, nil)
+	_, err = tx.Exec(`DELETE FROM x`)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(tx.Commit(), qt.Equals, nil)
+	c.Assert(db.QueryCount(), qt.Equals, 3)
+}
+
+func TestStatementsNotRecorded(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	c.Setenv("PGTESTLOG", "")
+	db, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+	_, err = db.Exec(`SELECT 1`)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(db.Statements(), qt.IsNil)
+	c.Assert(func() { db.QueryCount() }, qt.PanicMatches, `postgrestest: QueryCount called on a DB that does not record statements; use WithQueryCount`)
+}
@@ -0,0 +1,578 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Option configures a DB created by NewWithOptions.
+type Option func(*options)
+
+// options holds the configuration built up by Option values.
+type options struct {
+	// err holds the first error from an invalid option.
+	err error
+
+	// driverName holds the database/sql driver to use.
+	driverName string
+
+	// conn holds connection parameters that override the PG*
+	// environment variables.
+	conn map[string]string
+
+	// schemaPrefix holds the prefix for the test schema name.
+	schemaPrefix string
+
+	// timeout holds the timeout for creating and closing the DB.
+	timeout time.Duration
+
+	// keepOnFailure holds whether the test schema is kept when the
+	// test fails.
+	keepOnFailure bool
+
+	// maxConns holds the maximum number of open connections.
+	maxConns int
+
+	// waitTimeout and waitInterval hold the parameters given to
+	// WithWaitFor.
+	waitTimeout  time.Duration
+	waitInterval time.Duration
+
+	// logf, if non-nil, is called for each statement executed.
+	logf func(query string, args []interface{}, d time.Duration, err error)
+
+	// slowThreshold, if non-zero, holds the duration above which
+	// statements are logged as slow.
+	slowThreshold time.Duration
+
+	// countQueries holds whether statements are recorded so that
+	// they can be counted with QueryCount.
+	countQueries bool
+
+	// roles holds the roles created if they do not already exist.
+	roles []RoleSpec
+
+	// grants holds the privileges given to existing roles.
+	grants []Grant
+
+	// minVersion holds the minimum server version required.
+	minVersion string
+
+	// extensions holds the extensions required.
+	extensions []string
+
+	// extensionsBestEffort holds whether extensions that are not
+	// available are skipped rather than causing an error.
+	extensionsBestEffort bool
+
+	// staleAge holds the age of stale test schemas and databases
+	// to drop before creating the DB, or zero.
+	staleAge time.Duration
+
+	// setup holds the steps that are run to set up the schema,
+	// in order.
+	setup []setupStep
+
+	// snapshotStructure holds whether SnapshotStructure is called
+	// after the setup steps.
+	snapshotStructure bool
+}
+
+// schemaPrefixPattern matches valid schema name prefixes. Only
+// characters that do not need quoting are allowed so that the name
+// can be used directly in the search path.
+var schemaPrefixPattern = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// WithDSN returns an option that connects using the given libpq
+// connection string, in either keyword/value or URL form. Parameters
+// that it does not set still default to the PG* environment
+// variables.
+func WithDSN(dsn string) Option {
+	return func(o *options) {
+		params, err := parseConnString(dsn)
+		if err != nil {
+			o.setErr(fmt.Errorf("invalid DSN: %w", err))
+			return
+		}
+		if o.conn == nil {
+			o.conn = make(map[string]string)
+		}
+		for key, val := range params {
+			o.conn[key] = val
+		}
+	}
+}
+
+// WithDriver returns an option that connects using the named
+// database/sql driver rather than lib/pq's "postgres" driver. The
+// driver must be registered, for example by importing pgx's
+// database/sql driver:
+//
+//	import _ "github.com/jackc/pgx/v4/stdlib"
+//	...
+//	db, err := postgrestest.NewWithOptions(postgrestest.WithDriver("pgx"))
+//
+// To open native pgx connections to the test schema, pass DSN to
+// pgx.Connect or pgxpool.Connect.
+func WithDriver(name string) Option {
+	return func(o *options) {
+		o.driverName = name
+	}
+}
+
+// WithLogger returns an option that calls logf for every statement
+// executed through the DB, with its arguments, duration and any
+// error. The statements are also recorded; see Statements. When used
+// with NewForTest, the recorded statements are logged if the test
+// fails.
+func WithLogger(logf func(query string, args []interface{}, d time.Duration, err error)) Option {
+	return func(o *options) {
+		o.logf = logf
+	}
+}
+
+// WithSlowQueryThreshold returns an option that logs each statement
+// executed through the DB that takes longer than threshold, with its
+// duration and SQL. This helps find tests whose queries quietly
+// dominate the run time of a suite. Slow statements are passed to the
+// function given to WithLogger, which is then called for them only;
+// without WithLogger they are written to standard error. All the
+// statements are still recorded; see Statements.
+//
+// By default, slow statements are not logged.
+func WithSlowQueryThreshold(threshold time.Duration) Option {
+	return func(o *options) {
+		if threshold <= 0 {
+			o.setErr(fmt.Errorf("invalid slow query threshold %v", threshold))
+			return
+		}
+		o.slowThreshold = threshold
+	}
+}
+
+// WithQueryCount returns an option that records the statements
+// executed through the DB so that they can be counted with QueryCount.
+func WithQueryCount() Option {
+	return func(o *options) {
+		o.countQueries = true
+	}
+}
+
+// WithTimeout returns an option that sets the timeout for creating the
+// test schema, for dropping it on Close, and for taking and restoring
+// snapshots with Snapshot and Restore. The default is 5 seconds.
+func WithTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.timeout = d
+	}
+}
+
+// WithSchemaPrefix returns an option that sets the prefix of the
+// randomly named test schema, "go_test_" by default. The prefix may
+// contain only lower case letters, digits and underscores, and may not
+// start with a digit.
+func WithSchemaPrefix(prefix string) Option {
+	return func(o *options) {
+		if !schemaPrefixPattern.MatchString(prefix) {
+			o.setErr(fmt.Errorf("invalid schema prefix %q", prefix))
+			return
+		}
+		o.schemaPrefix = prefix
+	}
+}
+
+// WithKeepOnFailure returns an option that, when keep is true, leaves
+// the test schema in place if the test fails, as if PGTESTKEEPDB were
+// set. It only has an effect on DBs created by NewForTest, which knows
+// whether the test has failed.
+func WithKeepOnFailure(keep bool) Option {
+	return func(o *options) {
+		o.keepOnFailure = keep
+	}
+}
+
+// WithMaxConns returns an option that limits the number of open
+// connections to the database; see sql.DB.SetMaxOpenConns.
+func WithMaxConns(n int) Option {
+	return func(o *options) {
+		o.maxConns = n
+	}
+}
+
+// WithMinVersion returns an option that makes NewWithOptions fail with
+// an error matching ErrUnsupported if the server is older than the
+// given version; see RequireVersion.
+func WithMinVersion(version string) Option {
+	return func(o *options) {
+		o.minVersion = version
+	}
+}
+
+// WithExtensions returns an option that creates the named extensions
+// in the test schema, making NewWithOptions fail with an error
+// matching ErrUnsupported if any of them is not available; see
+// RequireExtensions.
+func WithExtensions(names ...string) Option {
+	return func(o *options) {
+		o.extensions = append(o.extensions, names...)
+	}
+}
+
+// WithExtensionsBestEffort returns an option that makes WithExtensions
+// skip any extension that is not available on the server, or that the
+// connecting role is not allowed to create, rather than failing. A
+// note is printed to stderr for each extension skipped, and
+// SkippedExtensions reports which they were. Other errors still cause
+// NewWithOptions to fail.
+func WithExtensionsBestEffort() Option {
+	return func(o *options) {
+		o.extensionsBestEffort = true
+	}
+}
+
+// WithGrants returns an option that gives existing roles privileges
+// in the test schema once it has been created, before any schema
+// setup options are applied, so that a test can connect as, for
+// example, a read-only application role. NewWithOptions fails if any
+// of the roles does not exist. The privileges are removed along with
+// the schema.
+func WithGrants(grants ...Grant) Option {
+	return func(o *options) {
+		for _, g := range grants {
+			for _, priv := range g.Privileges {
+				if !privilegePattern.MatchString(priv) {
+					o.setErr(fmt.Errorf("invalid privilege %q for role %q", priv, g.Role))
+					return
+				}
+			}
+		}
+		o.grants = append(o.grants, grants...)
+	}
+}
+
+// WithRoles returns an option that creates the given roles once the
+// test schema has been created, unless they already exist, and gives
+// them their privileges in the schema as WithGrants does. The
+// connecting role is made a member of each role it creates so that
+// connections can act as it with SET ROLE, and needs the CREATEROLE
+// privilege.
+//
+// Roles that NewWithOptions creates are dropped when the DB is closed.
+// Roles that already existed are left in place, as they may be shared
+// with other tests; only their privileges in the schema are removed.
+func WithRoles(roles ...RoleSpec) Option {
+	return func(o *options) {
+		for _, r := range roles {
+			if r.Name == "" {
+				o.setErr(errors.New("empty role name"))
+				return
+			}
+			for _, attr := range r.Attributes {
+				if !attributePattern.MatchString(attr) {
+					o.setErr(fmt.Errorf("invalid attribute %q for role %q", attr, r.Name))
+					return
+				}
+			}
+			for _, priv := range r.Privileges {
+				if !privilegePattern.MatchString(priv) {
+					o.setErr(fmt.Errorf("invalid privilege %q for role %q", priv, r.Name))
+					return
+				}
+			}
+		}
+		o.roles = append(o.roles, roles...)
+	}
+}
+
+// WithWaitFor returns an option that waits for up to the given timeout
+// for the server to accept connections before creating the test
+// schema, trying first after the given interval and then backing off;
+// see WaitUntilReady. The wait is in addition to the timeout set by
+// WithTimeout.
+func WithWaitFor(timeout, interval time.Duration) Option {
+	return func(o *options) {
+		o.waitTimeout = timeout
+		o.waitInterval = interval
+	}
+}
+
+// WithStaleCleanup returns an option that calls CleanupStale with the
+// given age before creating the DB, so that test schemas and
+// databases left behind by killed test runs do not accumulate. It
+// connects with the same parameters as the DB, including any set by
+// WithDSN.
+func WithStaleCleanup(olderThan time.Duration) Option {
+	return func(o *options) {
+		o.staleAge = olderThan
+	}
+}
+
+// dataSource returns the driver name and data source for connecting
+// with the configured connection parameters, without a search path.
+func (o *options) dataSource() (driverName, dataSource string) {
+	driverName = o.driverName
+	if driverName == "" {
+		driverName = "postgres"
+	}
+	return driverName, connString(driverParams(o.conn))
+}
+
+// waitUntilReady waits as configured by WithWaitFor.
+func (o *options) waitUntilReady() error {
+	ctx, cancel := context.WithTimeout(context.Background(), o.waitTimeout)
+	defer cancel()
+	interval := o.waitInterval
+	if interval <= 0 {
+		interval = defaultWaitInterval
+	}
+	driverName, dataSource := o.dataSource()
+	return waitUntilReady(ctx, driverName, dataSource, interval)
+}
+
+// setErr records err unless an error has already been recorded.
+func (o *options) setErr(err error) {
+	if o.err == nil {
+		o.err = err
+	}
+}
+
+// setupStep holds a single step of schema setup.
+type setupStep struct {
+	// what describes the step for error messages.
+	what string
+	// sql returns the SQL to execute.
+	sql func() (string, error)
+	// migrate, if non-nil, is called instead of executing SQL.
+	migrate func(db *sql.DB) error
+}
+
+// WithSchemaSQL returns an option that executes the given SQL
+// statements in the new test schema before NewWithOptions returns.
+func WithSchemaSQL(sql string) Option {
+	return func(o *options) {
+		o.setup = append(o.setup, setupStep{
+			what: "schema SQL",
+			sql: func() (string, error) {
+				return sql, nil
+			},
+		})
+	}
+}
+
+// WithSchemaFiles returns an option that executes the SQL statements
+// in each of the given files, in order, in the new test schema before
+// NewWithOptions returns. The files may be gzip-compressed, as with
+// LoadSQLFile.
+func WithSchemaFiles(paths ...string) Option {
+	return func(o *options) {
+		for _, path := range paths {
+			path := path
+			o.setup = append(o.setup, setupStep{
+				what: "schema file " + path,
+				sql: func() (string, error) {
+					data, err := readFileMaybeGzipped(path)
+					if err != nil {
+						return "", err
+					}
+					return string(data), nil
+				},
+			})
+		}
+	}
+}
+
+// WithSchemaFS returns an option that executes the SQL statements in
+// each file in fsys matching the given pattern (see fs.Glob), in
+// lexical order, in the new test schema before NewWithOptions
+// returns. The files may be gzip-compressed. This works well with
+// embed.FS, for example:
+//
+//	//go:embed migrations/*.sql
+//	var migrations embed.FS
+//	...
+//	db, err := postgrestest.NewWithOptions(
+//		postgrestest.WithSchemaFS(migrations, "migrations/*.sql"),
+//	)
+//
+// It is an error if no files match the pattern.
+func WithSchemaFS(fsys fs.FS, pattern string) Option {
+	return func(o *options) {
+		paths, err := fs.Glob(fsys, pattern)
+		if err != nil {
+			o.setErr(fmt.Errorf("cannot find schema files: %w", err))
+			return
+		}
+		if len(paths) == 0 {
+			o.setErr(fmt.Errorf("no schema files match %q", pattern))
+			return
+		}
+		for _, path := range paths {
+			path := path
+			o.setup = append(o.setup, setupStep{
+				what: "schema file " + path,
+				sql: func() (string, error) {
+					f, err := fsys.Open(path)
+					if err != nil {
+						return "", err
+					}
+					defer f.Close()
+					data, err := readMaybeGzipped(f)
+					if err != nil {
+						return "", err
+					}
+					return string(data), nil
+				},
+			})
+		}
+	}
+}
+
+// WithMigrator returns an option that calls migrate with the new
+// DB before NewWithOptions returns. As with the other schema setup
+// options, the search path is set to the test schema, so migrate can
+// use an existing migration tool to create the schema.
+func WithMigrator(migrate func(db *sql.DB) error) Option {
+	return func(o *options) {
+		o.setup = append(o.setup, setupStep{
+			what:    "migrator",
+			migrate: migrate,
+		})
+	}
+}
+
+// WithSnapshotStructure returns an option that calls SnapshotStructure
+// once all the schema setup options have been applied, so that the
+// test can check with AssertNoStructureChange that it runs no DDL.
+func WithSnapshotStructure() Option {
+	return func(o *options) {
+		o.snapshotStructure = true
+	}
+}
+
+// NewWithOptions is like New except that the DB is configured with
+// the given options. Options that are not given default to the
+// behaviour of New, including the use of environment variables.
+//
+// Schema setup options such as WithSchemaSQL and WithSchemaFiles are
+// applied in the order given, with the search path already set to the
+// new schema. If any of them fails, the schema is dropped and the
+// returned error identifies the failing step.
+func NewWithOptions(opts ...Option) (*DB, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.err != nil {
+		return nil, o.err
+	}
+	if o.waitTimeout > 0 && !PgTestDisable() {
+		if err := o.waitUntilReady(); err != nil {
+			return nil, err
+		}
+	}
+	timeout := o.timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if o.staleAge > 0 && !PgTestDisable() {
+		driverName, dataSource := o.dataSource()
+		if _, err := cleanupStale(ctx, driverName, dataSource, o.staleAge); err != nil {
+			return nil, err
+		}
+	}
+	db, err := newDB(ctx, &o)
+	if err != nil {
+		return nil, err
+	}
+	db.keepOnFailure = o.keepOnFailure
+	if o.maxConns > 0 {
+		db.SetMaxOpenConns(o.maxConns)
+	}
+	if err := db.checkRequirements(&o); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if len(o.roles) > 0 {
+		if err := db.createRoles(o.roles); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	if len(o.grants) > 0 {
+		if err := db.applyGrants(o.grants); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	for _, step := range o.setup {
+		if err := db.runSetupStep(step); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	if o.snapshotStructure {
+		if err := db.SnapshotStructure(); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	db.ResetQueryCount()
+	return db, nil
+}
+
+// runSetupStep executes the SQL for the given setup step, or calls
+// its migrate function.
+func (pg *DB) runSetupStep(step setupStep) error {
+	if step.migrate != nil {
+		if err := step.migrate(pg.DB); err != nil {
+			return fmt.Errorf("cannot run %s: %w", step.what, err)
+		}
+		return nil
+	}
+	sql, err := step.sql()
+	if err != nil {
+		return fmt.Errorf("cannot read %s: %w", step.what, err)
+	}
+	if _, err := pg.DB.Exec(sql); err != nil {
+		return fmt.Errorf("cannot apply %s%s: %w", step.what, errorLine(sql, err), err)
+	}
+	return nil
+}
+
+// errorLine returns a description of the line of the given SQL that
+// caused err, if the error records its position, or the empty string
+// otherwise.
+func errorLine(sql string, err error) string {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || pqErr.Position == "" {
+		return ""
+	}
+	// The position is a 1-based index in characters.
+	pos, convErr := strconv.Atoi(pqErr.Position)
+	runes := []rune(sql)
+	if convErr != nil || pos < 1 || pos > len(runes) {
+		return ""
+	}
+	before := string(runes[:pos-1])
+	line := strings.Count(before, "\n") + 1
+	start := strings.LastIndex(before, "\n") + 1
+	text := sql[start:]
+	if end := strings.Index(text, "\n"); end >= 0 {
+		text = text[:end]
+	}
+	return fmt.Sprintf(" at line %d (%q)", line, strings.TrimSpace(text))
+}
@@ -0,0 +1,195 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest_test
+
+import (
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/postgrestest"
+)
+
+func TestNewWithOptions(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	dir := c.Mkdir()
+	path1 := filepath.Join(dir, "1.sql")
+	err := ioutil.WriteFile(path1, []byte(`CREATE TABLE x (id integer PRIMARY KEY)`), 0666)
+	c.Assert(err, qt.Equals, nil)
+	path2 := filepath.Join(dir, "2.sql")
+	err = ioutil.WriteFile(path2, []byte(`CREATE TABLE y (x_id integer REFERENCES x (id))`), 0666)
+	c.Assert(err, qt.Equals, nil)
+
+	db, err := postgrestest.NewWithOptions(
+		postgrestest.WithSchemaFiles(path1, path2),
+		postgrestest.WithSchemaSQL(`INSERT INTO x VALUES (1); INSERT INTO y VALUES (1)`),
+	)
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+	db.AssertTables(t, []string{"x", "y"})
+	var count int
+	err = db.QueryRow(`SELECT COUNT(*) FROM y`).Scan(&count)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(count, qt.Equals, 1)
+}
+
+func TestNewWithOptionsError(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	path := filepath.Join(c.Mkdir(), "bad.sql")
+	err := ioutil.WriteFile(path, []byte("CREATE TABLE x (id integer);\nCREATE TABLE y (id nosuchtype);\n"), 0666)
+	c.Assert(err, qt.Equals, nil)
+
+	// Find out which test schemas exist beforehand.
+	sdb, err := sql.Open("postgres", "")
+	c.Assert(err, qt.Equals, nil)
+	defer sdb.Close()
+	countSchemas := func() int {
+		var n int
+		err := sdb.QueryRow(`SELECT COUNT(*) FROM pg_namespace WHERE nspname LIKE 'go\_test\_%'`).Scan(&n)
+		c.Assert(err, qt.Equals, nil)
+		return n
+	}
+	before := countSchemas()
+
+	db, err := postgrestest.NewWithOptions(postgrestest.WithSchemaFiles(path))
+	c.Assert(err, qt.ErrorMatches, `cannot apply schema file .*bad.sql at line 2 \("CREATE TABLE y \(id nosuchtype\);"\): .*type "nosuchtype" does not exist`)
+	c.Assert(db, qt.IsNil)
+	// The partially migrated schema should have been removed.
+	c.Assert(countSchemas(), qt.Equals, before)
+}
+
+func TestNewWithOptionsFSAndMigrator(t *testing.T) {
+	c := qt.New(t)
+	fsys := fstest.MapFS{
+		"migrations/2.sql": {Data: []byte(`CREATE TABLE y (x_id integer REFERENCES x (id))`)},
+		"migrations/1.sql": {Data: []byte(`CREATE TABLE x (id integer PRIMARY KEY)`)},
+		"other.sql":        {Data: []byte(`invalid`)},
+	}
+	db, err := postgrestest.NewWithOptions(
+		postgrestest.WithSchemaFS(fsys, "migrations/*.sql"),
+		postgrestest.WithMigrator(func(db *sql.DB) error {
+			_, err := db.Exec(`INSERT INTO x VALUES (1); INSERT INTO y VALUES (1)`)
+			return err
+		}),
+	)
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+	db.AssertTables(t, []string{"x", "y"})
+	var count int
+	err = db.QueryRow(`SELECT COUNT(*) FROM y`).Scan(&count)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(count, qt.Equals, 1)
+}
+
+func TestNewWithOptionsMigratorError(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.NewWithOptions(
+		postgrestest.WithMigrator(func(db *sql.DB) error {
+			return errors.New("bad migration")
+		}),
+	)
+	c.Assert(err, qt.ErrorMatches, `cannot run migrator: bad migration`)
+	c.Assert(db, qt.IsNil)
+}
+
+var invalidOptionTests = []struct {
+	about       string
+	opt         postgrestest.Option
+	expectError string
+}{{
+	about:       "DSN without value",
+	opt:         postgrestest.WithDSN("host"),
+	expectError: `invalid DSN: missing "=" after "host"`,
+}, {
+	about:       "DSN with unterminated quote",
+	opt:         postgrestest.WithDSN("host=localhost user='bob"),
+	expectError: `invalid DSN: unterminated quoted value for "user"`,
+}, {
+	about:       "schema prefix needing quotes",
+	opt:         postgrestest.WithSchemaPrefix("Test-"),
+	expectError: `invalid schema prefix "Test-"`,
+}, {
+	about:       "no matching schema files",
+	opt:         postgrestest.WithSchemaFS(fstest.MapFS{}, "*.sql"),
+	expectError: `no schema files match "\*\.sql"`,
+}, {
+	about:       "zero slow query threshold",
+	opt:         postgrestest.WithSlowQueryThreshold(0),
+	expectError: `invalid slow query threshold 0s`,
+}, {
+	about:       "invalid privilege",
+	opt:         postgrestest.WithGrants(postgrestest.Grant{Role: "reader", Privileges: []string{"SELECT; DROP TABLE x"}}),
+	expectError: `invalid privilege "SELECT; DROP TABLE x" for role "reader"`,
+}, {
+	about:       "empty role name",
+	opt:         postgrestest.WithRoles(postgrestest.RoleSpec{}),
+	expectError: `empty role name`,
+}, {
+	about:       "invalid role attribute",
+	opt:         postgrestest.WithRoles(postgrestest.RoleSpec{Name: "app", Attributes: []string{"PASSWORD 'x'"}}),
+	expectError: `invalid attribute "PASSWORD 'x'" for role "app"`,
+}, {
+	about:       "unregistered driver",
+	opt:         postgrestest.WithDriver("nosuchdriver"),
+	expectError: `cannot open database: sql: unknown driver "nosuchdriver".*`,
+}}
+
+func TestNewWithOptionsInvalid(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range invalidOptionTests {
+		c.Run(test.about, func(c *qt.C) {
+			db, err := postgrestest.NewWithOptions(test.opt)
+			c.Assert(err, qt.ErrorMatches, test.expectError)
+			c.Assert(db, qt.IsNil)
+		})
+	}
+}
+
+func TestNewWithOptionsConnection(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.NewWithOptions(
+		postgrestest.WithDSN(`application_name='my test'`),
+		postgrestest.WithSchemaPrefix("custom_"),
+		postgrestest.WithTimeout(10*time.Second),
+		postgrestest.WithMaxConns(1),
+	)
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+	c.Assert(db.Schema(), qt.Matches, `custom_[0-9a-f]+`)
+	c.Assert(db.Stats().MaxOpenConnections, qt.Equals, 1)
+	c.Assert(db.DSN(), qt.Matches, `.*application_name='my test'.*`)
+	var name string
+	err = db.QueryRow(`SELECT current_setting('application_name')`).Scan(&name)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(name, qt.Equals, "my test")
+}
+
+func TestWithKeepOnFailure(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	c.Setenv("PGTESTKEEPDB", "")
+	ft := &failedTB{TB: t}
+	db := postgrestest.NewForTest(ft, postgrestest.WithKeepOnFailure(true))
+	schema := db.Schema()
+	ft.runCleanups()
+	c.Assert(ft.logs, qt.DeepEquals, []string{
+		"postgrestest: test failed; keeping schema " + schema,
+	})
+
+	sdb, err := sql.Open("postgres", "")
+	c.Assert(err, qt.Equals, nil)
+	defer sdb.Close()
+	defer sdb.Exec(`DROP SCHEMA ` + schema + ` CASCADE`)
+	var count int
+	err = sdb.QueryRow(`SELECT COUNT(*) FROM pg_namespace WHERE nspname = $1`, schema).Scan(&count)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(count, qt.Equals, 1)
+}
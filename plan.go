@@ -0,0 +1,75 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// planNode holds the parts of a JSON query plan node that are
+// relevant to detecting disk spills.
+type planNode struct {
+	NodeType          string     `json:"Node Type"`
+	SortMethod        string     `json:"Sort Method"`
+	SortSpaceType     string     `json:"Sort Space Type"`
+	TempWrittenBlocks int64      `json:"Temp Written Blocks"`
+	Plans             []planNode `json:"Plans"`
+}
+
+// DiskSpills runs the given query with EXPLAIN ANALYZE and returns a
+// description of each plan node that spilled to temporary files on
+// disk because it exceeded work_mem, such as an external sort or a
+// batched hash join. It returns an empty slice if the query ran
+// entirely in memory.
+//
+// Because pg_stat_database counters are cluster-wide, the plan of
+// the query itself is examined instead, so the result is not
+// affected by other activity on the server. Note that EXPLAIN
+// ANALYZE really executes the query, including any side effects.
+func (pg *DB) DiskSpills(query string, args ...interface{}) ([]string, error) {
+	var data []byte
+	err := pg.DB.QueryRow(`EXPLAIN (ANALYZE, BUFFERS, FORMAT JSON) `+query, args...).Scan(&data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot explain query: %w", err)
+	}
+	var plans []struct {
+		Plan planNode `json:"Plan"`
+	}
+	if err := json.Unmarshal(data, &plans); err != nil {
+		return nil, fmt.Errorf("cannot parse query plan: %w", err)
+	}
+	spills := []string{}
+	var walk func(n planNode)
+	walk = func(n planNode) {
+		switch {
+		case n.SortSpaceType == "Disk":
+			spills = append(spills, fmt.Sprintf("%s (%s)", n.NodeType, n.SortMethod))
+		case n.TempWrittenBlocks > 0:
+			spills = append(spills, fmt.Sprintf("%s (%d temp blocks written)", n.NodeType, n.TempWrittenBlocks))
+		}
+		for _, child := range n.Plans {
+			walk(child)
+		}
+	}
+	for _, p := range plans {
+		walk(p.Plan)
+	}
+	return spills, nil
+}
+
+// AssertNoSpill fails the test if running the given query spills to
+// disk, as reported by DiskSpills.
+func (pg *DB) AssertNoSpill(t testing.TB, query string, args ...interface{}) {
+	t.Helper()
+	spills, err := pg.DiskSpills(query, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spills) > 0 {
+		t.Errorf("query spilled to disk in %s: %s", strings.Join(spills, ", "), query)
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest_test
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/postgrestest"
+)
+
+func TestAssertNoSpill(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+
+	// Use a single connection so that the work_mem setting
+	// applies to every query.
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec(`SET work_mem = '64kB'`)
+	c.Assert(err, qt.Equals, nil)
+
+	db.AssertNoSpill(t, `SELECT n FROM generate_series(1, $1::integer) n ORDER BY n DESC`, 10)
+
+	const bigSort = `SELECT n FROM generate_series(1, 100000) n ORDER BY n DESC`
+	spills, err := db.DiskSpills(bigSort)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(spills, qt.Not(qt.HasLen), 0)
+
+	rt := &recordingTB{TB: t}
+	db.AssertNoSpill(rt, bigSort)
+	c.Assert(rt.errors, qt.HasLen, 1)
+	c.Assert(rt.errors[0], qt.Matches, `query spilled to disk in .*: `+bigSort)
+}
@@ -0,0 +1,55 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// maxPollBackoff holds the maximum factor by which Poll increases
+// its polling interval.
+const maxPollBackoff = 8
+
+// Poll calls fn repeatedly until it returns true or the context is
+// done. This is useful for waiting for asynchronous behaviour, such
+// as a background job writing to the database; fn can run any
+// queries it likes.
+//
+// Poll waits for interval after the first attempt, then doubles the
+// wait after each further attempt up to a maximum of 8 times the
+// interval. Errors returned by fn are treated as transient and do
+// not stop the polling, but if the context is done before fn returns
+// true, the last such error is returned to help diagnose the failure.
+// The interval must be positive, as Poll would otherwise query the
+// database in a busy loop; if it is not, Poll returns an error without
+// calling fn.
+func (pg *DB) Poll(ctx context.Context, interval time.Duration, fn func() (bool, error)) error {
+	if interval <= 0 {
+		return fmt.Errorf("invalid poll interval %v", interval)
+	}
+	wait := interval
+	var lastErr error
+	for {
+		ok, err := fn()
+		if err == nil && ok {
+			return nil
+		}
+		if err != nil {
+			lastErr = err
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			if lastErr != nil {
+				return fmt.Errorf("condition not met before %v: %w", ctx.Err(), lastErr)
+			}
+			return fmt.Errorf("condition not met: %w", ctx.Err())
+		}
+		if wait *= 2; wait > maxPollBackoff*interval {
+			wait = maxPollBackoff * interval
+		}
+	}
+}
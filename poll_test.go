@@ -0,0 +1,67 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/postgrestest"
+)
+
+func TestPoll(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+
+	_, err = db.Exec(`CREATE TABLE jobs (id integer, done boolean)`)
+	c.Assert(err, qt.Equals, nil)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		db.Exec(`INSERT INTO jobs VALUES (1, true)`)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = db.Poll(ctx, 5*time.Millisecond, func() (bool, error) {
+		var done bool
+		err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM jobs WHERE done)`).Scan(&done)
+		return done, err
+	})
+	c.Assert(err, qt.Equals, nil)
+}
+
+func TestPollTimeout(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	predicateErr := errors.New("not yet")
+	err = db.Poll(ctx, time.Millisecond, func() (bool, error) {
+		return false, predicateErr
+	})
+	c.Assert(err, qt.ErrorMatches, `condition not met before context deadline exceeded: not yet`)
+	c.Assert(errors.Is(err, predicateErr), qt.Equals, true)
+}
+
+func TestPollInvalidInterval(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+
+	called := false
+	err = db.Poll(context.Background(), 0, func() (bool, error) {
+		called = true
+		return true, nil
+	})
+	c.Assert(err, qt.ErrorMatches, `invalid poll interval 0s`)
+	c.Assert(called, qt.Equals, false)
+}
@@ -0,0 +1,301 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+// templateComment is the comment on a template database. Unlike the
+// comment set by createdComment, it does not mark the database as
+// stale once it is old enough.
+const templateComment = "postgrestest: template"
+
+// Template holds a database that has been prepared once, for example
+// by running migrations, so that each test can use a quick copy of it
+// rather than preparing a database from scratch.
+//
+// A Template is typically created in TestMain and closed when all the
+// tests have run:
+//
+//	func TestMain(m *testing.M) {
+//		tmpl, err := postgrestest.NewTemplate(migrate)
+//		...
+//		code := m.Run()
+//		tmpl.Close()
+//		os.Exit(code)
+//	}
+//
+//	func TestSomething(t *testing.T) {
+//		db := tmpl.Clone(t)
+//		...
+//	}
+type Template struct {
+	name string
+}
+
+// NewTemplate creates a new database with a random name and calls
+// migrate to populate it. The database is then used as the template
+// for each database returned by Clone. See NewDB and NewFromTemplate
+// for the prerequisites.
+//
+// The *sql.DB passed to migrate is closed when migrate returns, because
+// Postgres cannot copy a database while it is in use. CleanupStale
+// does not drop template databases, so a template left behind by a
+// killed test run must be dropped by hand.
+func NewTemplate(migrate func(db *sql.DB) error) (*Template, error) {
+	db, err := NewDB()
+	if err != nil {
+		return nil, err
+	}
+	if err := migrate(db.DB); err != nil {
+		if errClose := db.Close(); errClose != nil {
+			return nil, fmt.Errorf("cannot close template database after failed migration: %w", errClose)
+		}
+		return nil, fmt.Errorf("cannot migrate template database: %w", err)
+	}
+	// The template sits idle while it is in use, so replace the
+	// creation comment to stop CleanupStale from dropping it.
+	_, err = db.Exec(`COMMENT ON DATABASE ` + pq.QuoteIdentifier(db.database) + ` IS '` + templateComment + `'`)
+	if err != nil {
+		if errClose := db.Close(); errClose != nil {
+			return nil, fmt.Errorf("cannot close template database after failing to mark it: %w", errClose)
+		}
+		return nil, fmt.Errorf("cannot mark template database: %w", err)
+	}
+	// Close the connection but keep the database.
+	if err := db.DB.Close(); err != nil {
+		return nil, fmt.Errorf("cannot close template database: %w", err)
+	}
+	return &Template{
+		name: db.database,
+	}, nil
+}
+
+// Name returns the name of the template database.
+func (tmpl *Template) Name() string {
+	return tmpl.name
+}
+
+// Clone returns a new copy of the template database, using
+// NewFromTemplate, which is dropped when the test and all its subtests
+// complete. Errors are reported through t as for NewForTest.
+func (tmpl *Template) Clone(t testing.TB) *DB {
+	t.Helper()
+	db, err := NewFromTemplate(tmpl.name)
+	return forTest(t, db, err)
+}
+
+// Close drops the template database. It should be called when all the
+// databases cloned from it have been closed, as ResetToTemplate needs
+// the template to exist.
+func (tmpl *Template) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+	return dropDatabase(ctx, tmpl.name)
+}
+
+// PoolReset selects how a DatabasePool cleans a database that has
+// been used by a previous test before handing it out again.
+type PoolReset int
+
+const (
+	// PoolResetSchema drops the default schema of the database,
+	// usually "public", along with everything in it, and creates it
+	// again empty. The connecting role must own the schema, as it
+	// does if it is a superuser or, since PostgreSQL 15, if it
+	// created the database.
+	PoolResetSchema PoolReset = iota
+
+	// PoolResetTruncate removes all the data from the tables in the
+	// default schema with Reset, but keeps their structure. This is
+	// quicker, and suits tests that all expect the same structure
+	// and create it only if it does not already exist.
+	PoolResetTruncate
+)
+
+// DatabasePool holds a number of databases, created in advance as
+// by NewDB, which are handed out to tests in turn. This gives each
+// test the isolation of its own database without the cost of
+// creating one each time. Like a Template, a DatabasePool is
+// typically created in TestMain and closed when all the tests have
+// run.
+type DatabasePool struct {
+	size  int
+	reset PoolReset
+
+	// mu guards the fields below.
+	mu     sync.Mutex
+	idle   []string
+	closed bool
+}
+
+// NewDatabasePool creates size databases for the pool, which are
+// cleaned as given by reset before each use. See NewDB for the
+// prerequisites.
+func NewDatabasePool(size int, reset PoolReset) (*DatabasePool, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("invalid database pool size %d", size)
+	}
+	p := &DatabasePool{
+		size:  size,
+		reset: reset,
+	}
+	for i := 0; i < size; i++ {
+		name, err := newIdleDatabase()
+		if err != nil {
+			if errClose := p.Close(); errClose != nil {
+				fmt.Fprintf(os.Stderr, "postgrestest: %v\n", errClose)
+			}
+			return nil, err
+		}
+		p.idle = append(p.idle, name)
+	}
+	return p, nil
+}
+
+// newIdleDatabase creates a database as NewDB does and returns its
+// name, leaving no connections open to it.
+func newIdleDatabase() (string, error) {
+	db, err := NewDB()
+	if err != nil {
+		return "", err
+	}
+	// Close the connection but keep the database.
+	if err := db.DB.Close(); err != nil {
+		if errClose := db.Close(); errClose != nil {
+			fmt.Fprintf(os.Stderr, "postgrestest: %v\n", errClose)
+		}
+		return "", fmt.Errorf("cannot close pooled database: %w", err)
+	}
+	return db.database, nil
+}
+
+// New returns a DB connected to one of the pool's databases, cleaned
+// as selected when the pool was created. Closing the DB returns the
+// database to the pool rather than dropping it. If all the databases
+// are in use, a new one is created as by NewDB; it joins the pool
+// when it is closed if there is room, and is dropped otherwise.
+//
+// As with NewDB, the Schema method of the returned DB returns the
+// default schema of the database.
+func (p *DatabasePool) New() (*DB, error) {
+	if PgTestDisable() {
+		return nil, ErrDisabled
+	}
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, errors.New("cannot get database: pool has been closed")
+	}
+	var name string
+	if n := len(p.idle); n > 0 {
+		name, p.idle = p.idle[n-1], p.idle[:n-1]
+	}
+	p.mu.Unlock()
+	if name == "" {
+		db, err := NewDB()
+		if err != nil {
+			return nil, err
+		}
+		db.pool = p
+		return db, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+	params := map[string]string{"dbname": name}
+	dataSource := connString(params)
+	db, err := openDatabase(ctx, name, dataSource)
+	if err != nil {
+		if errPut := p.put(ctx, name); errPut != nil {
+			fmt.Fprintf(os.Stderr, "postgrestest: %v\n", errPut)
+		}
+		return nil, err
+	}
+	pg := &DB{
+		DB:         db,
+		database:   name,
+		driverName: "postgres",
+		dataSource: dataSource,
+		params:     effectiveParams(params),
+	}
+	if err := p.clean(ctx, pg); err != nil {
+		// Drop the database rather than returning it to the
+		// pool in an unknown state.
+		if errClose := pg.Close(); errClose != nil {
+			fmt.Fprintf(os.Stderr, "postgrestest: %v\n", errClose)
+		}
+		return nil, err
+	}
+	pg.pool = p
+	return pg, nil
+}
+
+// NewForTest is like New except that errors are reported through t,
+// and the DB is closed, returning its database to the pool, when the
+// test and all its subtests complete; see the NewForTest function.
+func (p *DatabasePool) NewForTest(t testing.TB) *DB {
+	t.Helper()
+	db, err := p.New()
+	return forTest(t, db, err)
+}
+
+// clean cleans the database of pg, which has been used before, and
+// sets its schema.
+func (p *DatabasePool) clean(ctx context.Context, pg *DB) error {
+	err := runWithContext(ctx, func(ctx context.Context) error {
+		return pg.DB.QueryRowContext(ctx, `SELECT current_schema()`).Scan(&pg.schema)
+	}, "connect to pooled database "+pg.database)
+	if err != nil {
+		return err
+	}
+	if p.reset == PoolResetTruncate {
+		return pg.Reset()
+	}
+	schema := pq.QuoteIdentifier(pg.schema)
+	return runWithContext(ctx, func(ctx context.Context) error {
+		_, err := pg.DB.ExecContext(ctx, "DROP SCHEMA "+schema+" CASCADE; CREATE SCHEMA "+schema)
+		return err
+	}, "reset pooled database "+pg.database)
+}
+
+// put returns the named database to the pool, or drops it if the pool
+// is full or has been closed.
+func (p *DatabasePool) put(ctx context.Context, name string) error {
+	p.mu.Lock()
+	if !p.closed && len(p.idle) < p.size {
+		p.idle = append(p.idle, name)
+		p.mu.Unlock()
+		return nil
+	}
+	p.mu.Unlock()
+	return dropDatabase(ctx, name)
+}
+
+// Close drops the databases in the pool. Databases that are still in
+// use are dropped when their DB is closed.
+func (p *DatabasePool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for len(p.idle) > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+		err := dropDatabase(ctx, p.idle[0])
+		cancel()
+		if err != nil {
+			return err
+		}
+		p.idle = p.idle[1:]
+	}
+	return nil
+}
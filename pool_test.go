@@ -0,0 +1,170 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest_test
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/postgrestest"
+)
+
+func TestTemplateClone(t *testing.T) {
+	c := qt.New(t)
+	admin, err := postgrestest.NewConn()
+	c.Assert(err, qt.Equals, nil)
+	defer admin.Close()
+	skipUnlessSuperuser(c, admin)
+
+	migrations := 0
+	tmpl, err := postgrestest.NewTemplate(func(db *sql.DB) error {
+		migrations++
+		_, err := db.Exec(`CREATE TABLE x (id text); INSERT INTO x VALUES ('a')`)
+		return err
+	})
+	c.Assert(err, qt.Equals, nil)
+	defer tmpl.Close()
+
+	for _, name := range []string{"one", "two"} {
+		t.Run(name, func(t *testing.T) {
+			c := qt.New(t)
+			db := tmpl.Clone(t)
+			// Rows inserted in other clones are not visible.
+			var count int
+			err := db.QueryRow(`SELECT COUNT(*) FROM x`).Scan(&count)
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(count, qt.Equals, 1)
+			_, err = db.Exec(`INSERT INTO x VALUES ('b')`)
+			c.Assert(err, qt.Equals, nil)
+		})
+	}
+	c.Assert(migrations, qt.Equals, 1)
+
+	c.Assert(tmpl.Close(), qt.Equals, nil)
+	var count int
+	err = admin.QueryRow(`SELECT COUNT(*) FROM pg_database WHERE datname = $1`, tmpl.Name()).Scan(&count)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(count, qt.Equals, 0)
+}
+
+func TestNewTemplateMigrationError(t *testing.T) {
+	c := qt.New(t)
+	admin, err := postgrestest.NewConn()
+	c.Assert(err, qt.Equals, nil)
+	defer admin.Close()
+	skipUnlessSuperuser(c, admin)
+
+	_, err = postgrestest.NewTemplate(func(db *sql.DB) error {
+		return errors.New("bad migration")
+	})
+	c.Assert(err, qt.ErrorMatches, `cannot migrate template database: bad migration`)
+}
+
+func TestTemplateNotStale(t *testing.T) {
+	c := qt.New(t)
+	admin, err := postgrestest.NewConn()
+	c.Assert(err, qt.Equals, nil)
+	defer admin.Close()
+	skipUnlessSuperuser(c, admin)
+
+	tmpl, err := postgrestest.NewTemplate(func(db *sql.DB) error {
+		return nil
+	})
+	c.Assert(err, qt.Equals, nil)
+	defer tmpl.Close()
+
+	// The template is idle, so only its comment stops CleanupStale
+	// from treating it as stale.
+	var comment string
+	err = admin.QueryRow(`SELECT shobj_description(oid, 'pg_database') FROM pg_database WHERE datname = $1`, tmpl.Name()).Scan(&comment)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(comment, qt.Equals, "postgrestest: template")
+}
+
+func TestDatabasePool(t *testing.T) {
+	c := qt.New(t)
+	admin, err := postgrestest.NewConn()
+	c.Assert(err, qt.Equals, nil)
+	defer admin.Close()
+	skipUnlessSuperuser(c, admin)
+
+	p, err := postgrestest.NewDatabasePool(1, postgrestest.PoolResetSchema)
+	c.Assert(err, qt.Equals, nil)
+	defer p.Close()
+	currentDatabase := func(db *postgrestest.DB) string {
+		var name string
+		err := db.QueryRow(`SELECT current_database()`).Scan(&name)
+		c.Assert(err, qt.Equals, nil)
+		return name
+	}
+	databaseExists := func(name string) bool {
+		var exists bool
+		err := admin.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_database WHERE datname = $1)`, name).Scan(&exists)
+		c.Assert(err, qt.Equals, nil)
+		return exists
+	}
+
+	db1, err := p.New()
+	c.Assert(err, qt.Equals, nil)
+	name1 := currentDatabase(db1)
+	_, err = db1.Exec(`CREATE TABLE x (id integer)`)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(db1.Close(), qt.Equals, nil)
+	c.Assert(databaseExists(name1), qt.Equals, true)
+
+	// The database is reused, without the table.
+	db2, err := p.New()
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(currentDatabase(db2), qt.Equals, name1)
+	tables, err := db2.Tables()
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(tables, qt.HasLen, 0)
+
+	// When the pool is empty, another database is created, which
+	// takes the free place in the pool when it is closed.
+	db3, err := p.New()
+	c.Assert(err, qt.Equals, nil)
+	name3 := currentDatabase(db3)
+	c.Assert(name3, qt.Not(qt.Equals), name1)
+	c.Assert(db3.Close(), qt.Equals, nil)
+	c.Assert(db2.Close(), qt.Equals, nil)
+	c.Assert(databaseExists(name1), qt.Equals, false)
+	c.Assert(databaseExists(name3), qt.Equals, true)
+
+	c.Assert(p.Close(), qt.Equals, nil)
+	c.Assert(databaseExists(name3), qt.Equals, false)
+	_, err = p.New()
+	c.Assert(err, qt.ErrorMatches, `cannot get database: pool has been closed`)
+}
+
+func TestDatabasePoolTruncate(t *testing.T) {
+	c := qt.New(t)
+	admin, err := postgrestest.NewConn()
+	c.Assert(err, qt.Equals, nil)
+	defer admin.Close()
+	skipUnlessSuperuser(c, admin)
+
+	p, err := postgrestest.NewDatabasePool(1, postgrestest.PoolResetTruncate)
+	c.Assert(err, qt.Equals, nil)
+	defer p.Close()
+	db := p.NewForTest(t)
+	_, err = db.Exec(`CREATE TABLE x (id integer); INSERT INTO x VALUES (1)`)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(db.Close(), qt.Equals, nil)
+
+	// The table is kept but its rows are removed.
+	db = p.NewForTest(t)
+	var count int
+	err = db.QueryRow(`SELECT COUNT(*) FROM x`).Scan(&count)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(count, qt.Equals, 0)
+}
+
+func TestNewDatabasePoolInvalidSize(t *testing.T) {
+	c := qt.New(t)
+	_, err := postgrestest.NewDatabasePool(0, postgrestest.PoolResetSchema)
+	c.Assert(err, qt.ErrorMatches, `invalid database pool size 0`)
+}
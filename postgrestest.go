@@ -6,18 +6,23 @@
 package postgrestest
 
 import (
+	"context"
 	"crypto/rand"
 	"database/sql"
+	"errors"
 	"fmt"
 	"os"
+	"sync"
 	"time"
 
 	_ "github.com/lib/pq"
-	errgo "gopkg.in/errgo.v1"
 )
 
 const defaultTimeout = 5 * time.Second
 
+// defaultSchemaPrefix holds the prefix of the names of test schemas.
+const defaultSchemaPrefix = "go_test_"
+
 // PgTestDisable returns whether Postgres should be disabled based on the
 // PGTESTDISABLE environment variable.
 func PgTestDisable() bool {
@@ -30,11 +35,72 @@ func PgTestDisable() bool {
 type DB struct {
 	*sql.DB
 	schema string
+
+	// conns holds the connection sampler started by TrackConns,
+	// if any. It is guarded by closeMu.
+	conns *connSampler
+
+	// database holds the name of the database created by NewDB
+	// or NewFromTemplate, which is dropped on Close instead of
+	// the schema.
+	database string
+
+	// template holds the name of the template database that
+	// database was copied from by NewFromTemplate, if any.
+	template string
+
+	// pool holds the DatabasePool that database was taken from,
+	// if any.
+	pool *DatabasePool
+
+	// snapshot holds the structure recorded by SnapshotStructure.
+	snapshot []string
+
+	// skippedExtensions holds the extensions that were not installed
+	// because of WithExtensionsBestEffort.
+	skippedExtensions []string
+
+	// dataSnapshots holds the snapshots taken by Snapshot, by name.
+	// It is guarded by closeMu.
+	dataSnapshots map[string]*dataSnapshot
+
+	// driverName and dataSource hold the arguments used to
+	// open DB, so that new connections can be made.
+	driverName string
+	dataSource string
+
+	// params holds the connection parameters returned by
+	// ConnConfig.
+	params map[string]string
+
+	// log holds the statements recorded if logging is enabled.
+	log *statementLog
+
+	// closeMu guards the fields below, which record how far
+	// closing has progressed, the handles returned by Open and
+	// NewRole, and the roles created by NewRole and WithRoles.
+	closeMu sync.Mutex
+	dropped bool
+	closed  bool
+	extra   []*sql.DB
+	roles   []string
+
+	// container holds the ID of the Docker container started by
+	// NewWithContainer, which is removed on Close.
+	container string
+
+	// timeout holds the timeout for Close, if set by WithTimeout.
+	timeout time.Duration
+
+	// keepOnFailure records whether WithKeepOnFailure was used, and
+	// keep whether the test schema should be kept on Close.
+	keepOnFailure bool
+	keep          bool
 }
 
 // ErrDisabled is returned by New when postgres testing has
 // been explicitly disabled.
-var ErrDisabled = errgo.New("postgres testing is disabled")
+var ErrDisabled = errors.New("postgres testing is disabled")
 
 // New connects to a Postgres instance and returns a database
 // connection that uses a newly created schema with
@@ -46,12 +112,16 @@ var ErrDisabled = errgo.New("postgres testing is disabled")
 // with.
 //
 // If the environment variable PGTESTDISABLE is non-empty
-// ErrDisabled will be returned.
+// ErrDisabled will be returned. If the server cannot be
+// reached, the returned error will match ErrUnavailable.
 //
 // If the environment variable PGTESTKEEPDB is non-empty,
 // the name of the test schema will be printed and the
 // data will not be deleted.
 //
+// If the environment variable PGTESTLOG is non-empty, the
+// statements executed are recorded; see Statements.
+//
 // For optimal test performance, we recommend setting
 // the following Postgres config values in your testing
 // or development environment (BUT NEVER IN PRODUCTION):
@@ -64,70 +134,296 @@ var ErrDisabled = errgo.New("postgres testing is disabled")
 // and corruption. However, they should not have any
 // negative impact on ephemeral tests.
 func New() (*DB, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+	return NewContext(ctx)
+}
+
+// NewContext is like New except that creating the test schema is
+// governed by the given context rather than by a fixed timeout. If
+// the context is already done, NewContext returns its error
+// immediately.
+func NewContext(ctx context.Context) (*DB, error) {
+	return newDB(ctx, &options{})
+}
+
+// newDB is like NewContext except that the connection and schema
+// name are configured by the given options.
+func newDB(ctx context.Context, o *options) (*DB, error) {
 	if PgTestDisable() {
 		return nil, ErrDisabled
 	}
-	name := randomSchemaName()
-	db, err := sql.Open("postgres", "search_path="+name)
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("cannot create test database: %w", err)
+	}
+	driverName := o.driverName
+	if driverName == "" {
+		driverName = "postgres"
+	}
+	prefix := o.schemaPrefix
+	if prefix == "" {
+		prefix = defaultSchemaPrefix
+	}
+	name := randomName(prefix)
+	params := make(map[string]string)
+	for key, val := range o.conn {
+		params[key] = val
+	}
+	params["search_path"] = name
+	dataSource := connString(driverParams(params))
+	var log *statementLog
+	if o.logf != nil || o.slowThreshold > 0 || o.countQueries || os.Getenv("PGTESTLOG") != "" {
+		log = &statementLog{logf: o.logf, slowThreshold: o.slowThreshold}
+	}
+	var db *sql.DB
+	var err error
+	if log != nil {
+		db, err = openLogged(driverName, dataSource, log)
+	} else {
+		db, err = sql.Open(driverName, dataSource)
+	}
 	if err != nil {
-		return nil, errgo.Notef(err, "cannot open database")
+		return nil, fmt.Errorf("cannot open database: %w", err)
+	}
+	if err := ping(ctx, db); err != nil {
+		db.Close()
+		return nil, err
 	}
 
-	err = runWithTimeout(func(done chan error) {
-		_, err := db.Exec(`CREATE SCHEMA ` + name)
-		done <- err
-	}, defaultTimeout, "create schema")
+	err = runWithContext(ctx, func(ctx context.Context) error {
+		// Record the creation time so that CleanupStale can
+		// find the schema if it is never dropped.
+		_, err := db.ExecContext(ctx, `CREATE SCHEMA `+name+`; COMMENT ON SCHEMA `+name+` IS `+createdComment())
+		return err
+	}, "create schema")
 	if err != nil {
 		errClose := runWithTimeout(func(done chan error) {
-			db.Close()
-			done <- err
+			done <- db.Close()
 		}, defaultTimeout, "close test db after failing to create schema")
 		if errClose != nil {
-			return nil, errgo.Notef(errClose, "cannot create test database %q", name)
+			return nil, fmt.Errorf("cannot create test database %q: %w", name, errClose)
+		}
+		return nil, fmt.Errorf("cannot create test database %q: %w", name, err)
+	}
+	pg := &DB{
+		DB:         db,
+		schema:     name,
+		driverName: driverName,
+		dataSource: dataSource,
+		params:     effectiveParams(params),
+		timeout:    o.timeout,
+		log:        log,
+	}
+	// Creating the schema does not count as a query made by the
+	// test.
+	pg.ResetQueryCount()
+	return pg, nil
+}
+
+// ping checks that the database server can be reached, returning
+// an error that matches ErrUnavailable if not.
+func ping(ctx context.Context, db *sql.DB) error {
+	if err := runWithContext(ctx, db.PingContext, "connect to database"); err != nil {
+		return &unavailableError{
+			cause: err,
+			hint:  connectionHint(),
 		}
-		return nil, errgo.Notef(err, "cannot create test database %q", name)
+	}
+	return nil
+}
+
+// NewConn returns a connection to the Postgres server configured
+// by the PG* environment variables without creating a test schema.
+// This is useful for tests of server-level functionality that have no
+// need for an isolated schema.
+//
+// The Schema method of the returned DB returns the empty string, and
+// methods that operate on the test schema cannot be used. Close
+// just closes the connection.
+//
+// As with New, ErrDisabled is returned if the PGTESTDISABLE
+// environment variable is non-empty.
+func NewConn() (*DB, error) {
+	if PgTestDisable() {
+		return nil, ErrDisabled
+	}
+	db, err := sql.Open("postgres", "")
+	if err != nil {
+		return nil, fmt.Errorf("cannot open database: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+	if err := ping(ctx, db); err != nil {
+		db.Close()
+		return nil, err
 	}
 	return &DB{
-		DB:     db,
-		schema: name,
+		DB:         db,
+		driverName: "postgres",
+		params:     effectiveParams(nil),
 	}, nil
 }
 
-// Close removes the test database and closes the database connection. This
-// method should not be called from multiple goroutines.
+// Open returns a new database handle connected to the test schema,
+// independent of the one embedded in pg, for example to pass to a
+// server under test. The handle is closed when pg is closed; any
+// transactions in it must have finished by then.
+func (pg *DB) Open() (*sql.DB, error) {
+	pg.closeMu.Lock()
+	defer pg.closeMu.Unlock()
+	if pg.closed {
+		return nil, errors.New("cannot open database: test database has been closed")
+	}
+	db, err := sql.Open(pg.driverName, pg.dataSource)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open database: %w", err)
+	}
+	pg.extra = append(pg.extra, db)
+	return db, nil
+}
+
+// Close removes the test database and closes the database connection.
+// It is safe to call Close more than once and from multiple goroutines;
+// once the DB has been closed successfully, subsequent calls do nothing
+// and return nil. If closing fails, a later call will try again.
 func (pg *DB) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), pg.opTimeout())
+	defer cancel()
+	return pg.CloseContext(ctx)
+}
+
+// opTimeout returns the timeout set by WithTimeout, or the default.
+func (pg *DB) opTimeout() time.Duration {
+	if pg.timeout == 0 {
+		return defaultTimeout
+	}
+	return pg.timeout
+}
+
+// CloseContext is like Close except that dropping the test schema and
+// closing the connection are governed by the given context rather than
+// by a fixed timeout.
+func (pg *DB) CloseContext(ctx context.Context) error {
 	// If for some reason someone replaced our DB with nil, there's nothing to
 	// do here.
 	if pg.DB == nil {
 		return nil
 	}
-
-	if os.Getenv("PGTESTKEEPDB") != "" {
-		fmt.Fprintf(os.Stderr, "postgrestest schema: %v\n", pg.schema)
-		fmt.Fprintf(os.Stderr, "\tSET search_path TO %q;\n", pg.schema)
-		fmt.Fprintf(os.Stderr, "\tDROP SCHEMA %q CASCADE;\n", pg.schema)
+	pg.closeMu.Lock()
+	defer pg.closeMu.Unlock()
+	if pg.closed {
 		return nil
 	}
+	pg.conns.Stop()
 
-	// Drop the schema and close in goroutines, so that if it fails because
-	// someone has a lock on something, we can time out instead of hanging up
-	// indefinitely.
-	err := runWithTimeout(func(done chan error) {
-		_, err := pg.DB.Exec(fmt.Sprintf("DROP SCHEMA %q CASCADE;", pg.schema))
-		done <- err
-	}, defaultTimeout, "drop test schema "+pg.schema)
-	if err != nil {
-		return err
+	// Close any handles returned by Open first, as a database
+	// cannot be dropped while there are connections to it.
+	var errExtra error
+	for _, db := range pg.extra {
+		if err := db.Close(); err != nil && errExtra == nil {
+			errExtra = fmt.Errorf("cannot close connection: %w", err)
+		}
+	}
+	pg.extra = nil
+
+	// Roles would survive the schema or database being dropped.
+	if len(pg.roles) > 0 && !pg.keepDB() {
+		roles := append([]string(nil), pg.roles...)
+		err := runWithContext(ctx, func(ctx context.Context) error {
+			return pg.dropRoles(ctx, roles)
+		}, "drop test roles")
+		if err != nil {
+			return err
+		}
+		pg.roles = nil
 	}
 
-	err = runWithTimeout(func(done chan error) {
-		err := pg.DB.Close()
-		done <- err
-	}, defaultTimeout, "close test db")
+	var err error
+	if pg.database != "" {
+		err = pg.closeDatabase(ctx)
+	} else {
+		err = pg.closeSchema(ctx)
+	}
 	if err != nil {
 		return err
 	}
+	if pg.container != "" {
+		if err := pg.removeContainer(ctx); err != nil {
+			return err
+		}
+	}
+	pg.closed = true
+	return errExtra
+}
+
+// closeSchema drops the test schema and closes the connection. It
+// must be called with pg.closeMu held.
+func (pg *DB) closeSchema(ctx context.Context) error {
+	// A DB created by NewConn has no schema to drop.
+	if pg.schema != "" && !pg.dropped {
+		if pg.keepDB() {
+			fmt.Fprintf(os.Stderr, "postgrestest schema: %v\n", pg.schema)
+			fmt.Fprintf(os.Stderr, "\tSET search_path TO %q;\n", pg.schema)
+			fmt.Fprintf(os.Stderr, "\tDROP SCHEMA %q CASCADE;\n", pg.schema)
+			return nil
+		}
+
+		for name, snap := range pg.dataSnapshots {
+			if err := runWithContext(ctx, snap.drop(pg.DB), "drop snapshot "+name); err != nil {
+				return err
+			}
+			delete(pg.dataSnapshots, name)
+		}
+		// Drop the schema and close in goroutines, so that if it fails because
+		// someone has a lock on something, we can time out instead of hanging up
+		// indefinitely.
+		err := runWithContext(ctx, pg.dropSchema, "drop test schema "+pg.schema)
+		if err != nil {
+			return err
+		}
+		pg.dropped = true
+	}
 
+	return runWithContext(ctx, func(context.Context) error {
+		return pg.DB.Close()
+	}, "close test db")
+}
+
+// keepDB reports whether the test schema or database should be kept
+// rather than dropped on Close.
+func (pg *DB) keepDB() bool {
+	return pg.keep || os.Getenv("PGTESTKEEPDB") != ""
+}
+
+// dropSchema drops the test schema. If the pooled connection used
+// has been left in an aborted transaction (for example by a test
+// that ran BEGIN directly), the transaction is rolled back first.
+// If the pooled connection is unusable, a new connection is used.
+func (pg *DB) dropSchema(ctx context.Context) error {
+	stmt := fmt.Sprintf("DROP SCHEMA %q CASCADE;", pg.schema)
+	conn, err := pg.DB.Conn(ctx)
+	if err == nil {
+		defer conn.Close()
+		_, err = conn.ExecContext(ctx, stmt)
+		if SQLState(err) == "25P02" {
+			// in_failed_sql_transaction: rolling back also releases
+			// any locks that would block the drop.
+			if _, err = conn.ExecContext(ctx, "ROLLBACK"); err == nil {
+				_, err = conn.ExecContext(ctx, stmt)
+			}
+		}
+		if err == nil {
+			return nil
+		}
+	}
+	db, openErr := sql.Open(pg.driverName, pg.dataSource)
+	if openErr != nil {
+		return err
+	}
+	defer db.Close()
+	if _, retryErr := db.ExecContext(ctx, stmt); retryErr != nil {
+		return err
+	}
 	return nil
 }
 
@@ -140,11 +436,40 @@ func runWithTimeout(toRun func(chan error), timeout time.Duration, what string)
 	select {
 	case err := <-done:
 		if err != nil {
-			return errgo.Notef(err, "cannot "+what)
+			return fmt.Errorf("cannot %s: %w", what, err)
 		}
 		return nil
 	case <-time.After(timeout):
-		return errgo.Newf("timed out trying to " + what)
+		return fmt.Errorf("timed out trying to %s", what)
+	}
+}
+
+// runWithContext runs toRun in a goroutine, passing it ctx, and waits for it
+// to finish or for the context to be done. As with runWithTimeout, what
+// describes the thing toRun is trying to accomplish. If the context is
+// already done, toRun is not called.
+func runWithContext(ctx context.Context, toRun func(context.Context) error, what string) error {
+	ctxErr := func() error {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("timed out trying to %s: %w", what, ctx.Err())
+		}
+		return fmt.Errorf("cannot %s: %w", what, ctx.Err())
+	}
+	if ctx.Err() != nil {
+		return ctxErr()
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- toRun(ctx)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("cannot %s: %w", what, err)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctxErr()
 	}
 }
 
@@ -154,9 +479,14 @@ func (pg *DB) Schema() string {
 }
 
 func randomSchemaName() string {
+	return randomName(defaultSchemaPrefix)
+}
+
+// randomName returns a random identifier with the given prefix.
+func randomName(prefix string) string {
 	buf := make([]byte, 8)
 	if _, err := rand.Read(buf); err != nil {
 		panic(fmt.Errorf("cannot read random bytes: %v", err))
 	}
-	return fmt.Sprintf("go_test_%x", buf)
+	return fmt.Sprintf("%s%x", prefix, buf)
 }
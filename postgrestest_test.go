@@ -4,8 +4,11 @@
 package postgrestest_test
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"testing"
+	"time"
 
 	qt "github.com/frankban/quicktest"
 	"github.com/juju/postgrestest"
@@ -39,3 +42,110 @@ func TestNew(t *testing.T) {
 	c.Assert(row.Scan(&count), qt.Equals, nil)
 	c.Assert(count, qt.Equals, 0)
 }
+
+func TestNewContextCancelled(t *testing.T) {
+	c := qt.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := postgrestest.NewContext(ctx)
+	c.Assert(err, qt.ErrorMatches, `cannot create test database: context canceled`)
+	c.Assert(errors.Is(err, context.Canceled), qt.Equals, true)
+}
+
+func TestCloseContext(t *testing.T) {
+	c := qt.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	db, err := postgrestest.NewContext(ctx)
+	c.Assert(err, qt.Equals, nil)
+
+	cancelledCtx, cancelCancelled := context.WithCancel(context.Background())
+	cancelCancelled()
+	err = db.CloseContext(cancelledCtx)
+	c.Assert(err, qt.ErrorMatches, `cannot drop test schema go_test_.*: context canceled`)
+
+	err = db.CloseContext(ctx)
+	c.Assert(err, qt.Equals, nil)
+}
+
+func TestCloseConcurrent(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+
+	const n = 5
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			errs <- db.Close()
+		}()
+	}
+	for i := 0; i < n; i++ {
+		c.Assert(<-errs, qt.Equals, nil)
+	}
+	// Closing again after all that is still fine.
+	c.Assert(db.Close(), qt.Equals, nil)
+}
+
+func TestCloseAfterAbortedTransaction(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	schema := db.Schema()
+
+	// Leave the only connection in the pool in an aborted
+	// transaction holding a lock on a table in the schema.
+	db.SetMaxOpenConns(1)
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	c.Assert(err, qt.Equals, nil)
+	for _, stmt := range []string{`CREATE TABLE x (id integer)`, `BEGIN`, `LOCK TABLE x`} {
+		_, err = conn.ExecContext(ctx, stmt)
+		c.Assert(err, qt.Equals, nil)
+	}
+	_, err = conn.ExecContext(ctx, `SELECT 1/0`)
+	c.Assert(err, qt.ErrorMatches, `.*division by zero`)
+	c.Assert(conn.Close(), qt.Equals, nil)
+
+	err = db.Close()
+	c.Assert(err, qt.Equals, nil)
+
+	sdb, err := sql.Open("postgres", "")
+	c.Assert(err, qt.Equals, nil)
+	defer sdb.Close()
+	var count int
+	err = sdb.QueryRow(`SELECT COUNT(nspname) FROM pg_namespace WHERE nspname = $1`, schema).Scan(&count)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(count, qt.Equals, 0)
+}
+
+func TestNewConn(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+
+	conn, err := postgrestest.NewConn()
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(conn.Schema(), qt.Equals, "")
+
+	// The connection can see the other test schema.
+	var count int
+	err = conn.QueryRow(`SELECT COUNT(nspname) FROM pg_namespace WHERE nspname = $1`, db.Schema()).Scan(&count)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(count, qt.Equals, 1)
+
+	err = conn.Close()
+	c.Assert(err, qt.Equals, nil)
+}
+
+// skipUnlessSuperuser skips the test if the database connection
+// is not authenticated as a superuser.
+func skipUnlessSuperuser(c *qt.C, db *postgrestest.DB) {
+	var superuser string
+	err := db.QueryRow(`SELECT current_setting('is_superuser')`).Scan(&superuser)
+	c.Assert(err, qt.Equals, nil)
+	if superuser != "on" {
+		c.Skip("test requires a superuser")
+	}
+}
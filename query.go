@@ -0,0 +1,287 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// assertFasterRuns holds the number of times AssertFaster runs
+// its query.
+const assertFasterRuns = 3
+
+// Stream runs the given query and calls scan for each row of the
+// result, without buffering the results in memory. It stops early,
+// returning the error, if scan returns an error or the context is
+// cancelled. The rows are always closed before Stream returns.
+func (pg *DB) Stream(ctx context.Context, query string, scan func(*sql.Rows) error, args ...interface{}) error {
+	rows, err := pg.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("cannot run query: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := scan(rows); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("cannot read rows: %w", err)
+	}
+	return nil
+}
+
+// AssertFaster fails the test if the given query takes longer than
+// budget to run. The query is run several times and the median
+// wall-clock time, including reading all the result rows, is
+// compared against the budget to reduce noise.
+//
+// This is only a coarse guard against gross performance regressions:
+// timings are sensitive to the machine and load, so budgets should
+// be generous.
+func (pg *DB) AssertFaster(t testing.TB, budget time.Duration, query string, args ...interface{}) {
+	t.Helper()
+	times := make([]time.Duration, assertFasterRuns)
+	for i := range times {
+		start := time.Now()
+		if err := drainQuery(pg.DB, query, args...); err != nil {
+			t.Fatal(err)
+		}
+		times[i] = time.Since(start)
+	}
+	sort.Slice(times, func(i, j int) bool {
+		return times[i] < times[j]
+	})
+	if median := times[len(times)/2]; median > budget {
+		t.Errorf("query took %v (median of %d runs), exceeding budget of %v: %s", median, len(times), budget, query)
+	}
+}
+
+// drainQuery runs the given query and reads all its rows.
+func drainQuery(db *sql.DB, query string, args ...interface{}) error {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return fmt.Errorf("cannot run query: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("cannot read rows: %w", err)
+	}
+	return nil
+}
+
+// AssertSameData fails the test if the given table does not hold
+// the same rows when read through a as when read through b. The
+// table is looked up in the test schema of each DB, so this can be
+// used to compare two sessions on the same schema or a schema
+// and its replica. Rows are compared in a deterministic order, so
+// the physical order of the rows does not matter.
+func AssertSameData(t testing.TB, a, b *DB, table string) {
+	t.Helper()
+	rowsA, err := a.tableRows(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rowsB, err := b.tableRows(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if equalStrings(rowsA, rowsB) {
+		return
+	}
+	diff := diffLines(rowsA, rowsB)
+	if diff == "" {
+		diff = "(the rows differ only in the number of duplicates)"
+	}
+	t.Errorf("table %q holds different data (-a +b):\n%s", table, diff)
+}
+
+// tableRows returns the JSON representation of each row in the
+// given table, sorted.
+func (pg *DB) tableRows(table string) ([]string, error) {
+	name := pq.QuoteIdentifier(table)
+	if pg.schema != "" {
+		name = pq.QuoteIdentifier(pg.schema) + "." + name
+	}
+	rows, err := pg.DB.Query(fmt.Sprintf(`SELECT row_to_json(t)::text FROM %s t ORDER BY 1`, name))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read table %q: %w", table, err)
+	}
+	defer rows.Close()
+	var result []string
+	for rows.Next() {
+		var row string
+		if err := rows.Scan(&row); err != nil {
+			return nil, fmt.Errorf("cannot scan table %q: %w", table, err)
+		}
+		result = append(result, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read table %q: %w", table, err)
+	}
+	// Sort in Go as well, because the database collation might not
+	// order the rows the way diffLines expects.
+	sort.Strings(result)
+	return result, nil
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// returningPattern matches statements with a RETURNING clause once
+// string literals, quoted identifiers and comments have been removed
+// by stripLiterals.
+var returningPattern = regexp.MustCompile(`(?i)\breturning\b`)
+
+// dollarTagPattern matches the opening tag of a dollar-quoted string.
+var dollarTagPattern = regexp.MustCompile(`^\$([A-Za-z_][A-Za-z0-9_]*)?\$`)
+
+// stripLiterals returns the given SQL with each string literal,
+// quoted identifier and comment replaced by a space. Unterminated
+// ones extend to the end of the query.
+func stripLiterals(query string) string {
+	var b strings.Builder
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case strings.HasPrefix(query[i:], "--"):
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				end = len(query) - i
+			}
+			i += end
+		case strings.HasPrefix(query[i:], "/*"):
+			// Block comments nest.
+			depth := 0
+			for i < len(query) {
+				if strings.HasPrefix(query[i:], "/*") {
+					depth++
+					i += 2
+				} else if strings.HasPrefix(query[i:], "*/") {
+					depth--
+					i += 2
+					if depth == 0 {
+						break
+					}
+				} else {
+					i++
+				}
+			}
+		case c == '\'' || c == '"':
+			// Backslash escapes are only recognised in E'...' strings.
+			escapes := c == '\'' && i > 0 && (query[i-1] == 'e' || query[i-1] == 'E') && (i == 1 || !isIdentChar(query[i-2]))
+			for i++; i < len(query); i++ {
+				if escapes && query[i] == '\\' {
+					i++
+				} else if query[i] == c {
+					if i+1 < len(query) && query[i+1] == c {
+						// A doubled quote stands for itself.
+						i++
+					} else {
+						i++
+						break
+					}
+				}
+			}
+		case c == '$' && (i == 0 || !isIdentChar(query[i-1])) && dollarTagPattern.MatchString(query[i:]):
+			tag := dollarTagPattern.FindString(query[i:])
+			end := strings.Index(query[i+len(tag):], tag)
+			if end < 0 {
+				i = len(query)
+			} else {
+				i += len(tag) + end + len(tag)
+			}
+		default:
+			b.WriteByte(c)
+			i++
+			continue
+		}
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
+
+// isIdentChar reports whether c can appear in an unquoted identifier.
+func isIdentChar(c byte) bool {
+	return c == '_' || c == '$' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+// Mutate runs the given INSERT, UPDATE or DELETE statement and
+// returns the rows produced by its RETURNING clause, each as a map
+// from column name to value, along with the number of rows
+// affected.
+//
+// The statement is assumed to have a RETURNING clause if the word
+// "returning" appears outside its string literals, quoted identifiers
+// and comments; RETURNING is a reserved word, so elsewhere it can
+// only start such a clause. The rows are then read with a query and
+// the number affected is the number of rows returned, including for
+// a RETURNING clause inside a WITH query. Otherwise the statement is
+// executed without reading any rows, the returned slice is empty and
+// the number affected is the one reported by the server.
+func (pg *DB) Mutate(query string, args ...interface{}) (rows []map[string]interface{}, affected int64, err error) {
+	if !returningPattern.MatchString(stripLiterals(query)) {
+		result, err := pg.DB.Exec(query, args...)
+		if err != nil {
+			return nil, 0, fmt.Errorf("cannot run statement: %w", err)
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return nil, 0, fmt.Errorf("cannot get rows affected: %w", err)
+		}
+		return []map[string]interface{}{}, affected, nil
+	}
+	r, err := pg.DB.Query(query, args...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("cannot run statement: %w", err)
+	}
+	defer r.Close()
+	columns, err := r.Columns()
+	if err != nil {
+		return nil, 0, fmt.Errorf("cannot get columns: %w", err)
+	}
+	rows = []map[string]interface{}{}
+	for r.Next() {
+		values := make([]interface{}, len(columns))
+		ptrs := make([]interface{}, len(columns))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := r.Scan(ptrs...); err != nil {
+			return nil, 0, fmt.Errorf("cannot scan row: %w", err)
+		}
+		row := make(map[string]interface{}, len(columns))
+		for i, column := range columns {
+			row[column] = values[i]
+		}
+		rows = append(rows, row)
+	}
+	if err := r.Err(); err != nil {
+		return nil, 0, fmt.Errorf("cannot read rows: %w", err)
+	}
+	return rows, int64(len(rows)), nil
+}
@@ -0,0 +1,134 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/postgrestest"
+)
+
+func TestStream(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+
+	var got []int
+	err = db.Stream(context.Background(), `SELECT generate_series(1, $1)`, func(rows *sql.Rows) error {
+		var n int
+		if err := rows.Scan(&n); err != nil {
+			return err
+		}
+		got = append(got, n)
+		return nil
+	}, 5)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(got, qt.DeepEquals, []int{1, 2, 3, 4, 5})
+}
+
+func TestStreamCancel(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	n := 0
+	err = db.Stream(ctx, `SELECT generate_series(1, 1000000)`, func(rows *sql.Rows) error {
+		n++
+		if n == 3 {
+			cancel()
+		}
+		return nil
+	})
+	c.Assert(errors.Is(err, context.Canceled), qt.Equals, true)
+	c.Assert(n, qt.Equals, 3)
+}
+
+func TestAssertFaster(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+
+	db.AssertFaster(t, 5*time.Second, `SELECT $1::integer`, 1)
+
+	rt := &recordingTB{TB: t}
+	db.AssertFaster(rt, 10*time.Millisecond, `SELECT pg_sleep(0.05)`)
+	c.Assert(rt.errors, qt.HasLen, 1)
+	c.Assert(rt.errors[0], qt.Matches, `query took .* \(median of 3 runs\), exceeding budget of 10ms: SELECT pg_sleep\(0.05\)`)
+}
+
+func TestAssertSameData(t *testing.T) {
+	c := qt.New(t)
+	a, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer a.Close()
+	b, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer b.Close()
+
+	for _, db := range []*postgrestest.DB{a, b} {
+		_, err = db.Exec(`CREATE TABLE x (id integer, val text)`)
+		c.Assert(err, qt.Equals, nil)
+	}
+	_, err = a.Exec(`INSERT INTO x VALUES (1, 'a'), (2, 'b')`)
+	c.Assert(err, qt.Equals, nil)
+	_, err = b.Exec(`INSERT INTO x VALUES (2, 'b'), (1, 'a')`)
+	c.Assert(err, qt.Equals, nil)
+	postgrestest.AssertSameData(t, a, b, "x")
+
+	_, err = b.Exec(`UPDATE x SET val = 'c' WHERE id = 2`)
+	c.Assert(err, qt.Equals, nil)
+	rt := &recordingTB{TB: t}
+	postgrestest.AssertSameData(rt, a, b, "x")
+	c.Assert(rt.errors, qt.DeepEquals, []string{
+		`table "x" holds different data (-a +b):` + "\n" +
+			`-{"id":2,"val":"b"}` + "\n" +
+			`+{"id":2,"val":"c"}`,
+	})
+}
+
+func TestMutate(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+
+	_, err = db.Exec(`CREATE TABLE x (id serial, val text)`)
+	c.Assert(err, qt.Equals, nil)
+	rows, n, err := db.Mutate(`INSERT INTO x (val) VALUES ($1), ($2) RETURNING id, val`, "a", "b")
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(n, qt.Equals, int64(2))
+	c.Assert(rows, qt.DeepEquals, []map[string]interface{}{{
+		"id":  int64(1),
+		"val": "a",
+	}, {
+		"id":  int64(2),
+		"val": "b",
+	}})
+
+	rows, n, err = db.Mutate(`UPDATE x SET val = 'c'`)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(n, qt.Equals, int64(2))
+	c.Assert(rows, qt.HasLen, 0)
+
+	// The word "returning" in a literal or a comment does not make a
+	// RETURNING clause.
+	rows, n, err = db.Mutate(`UPDATE x SET val = 'returning' -- no returning clause`)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(n, qt.Equals, int64(2))
+	c.Assert(rows, qt.HasLen, 0)
+	rows, n, err = db.Mutate(`/* returning */ DELETE FROM x WHERE val = $$returning$$ RETURNING id`)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(n, qt.Equals, int64(2))
+	c.Assert(rows, qt.HasLen, 2)
+}
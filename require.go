@@ -0,0 +1,150 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// RequireVersion returns an error matching ErrUnsupported if the
+// server is older than the given version, such as "9.6" or "13.2".
+func (pg *DB) RequireVersion(min string) error {
+	want, err := versionNum(min)
+	if err != nil {
+		return err
+	}
+	var got int
+	var version string
+	err = pg.DB.QueryRow(`SELECT current_setting('server_version_num')::integer, current_setting('server_version')`).Scan(&got, &version)
+	if err != nil {
+		return fmt.Errorf("cannot get server version: %w", err)
+	}
+	if got < want {
+		return fmt.Errorf("%w: server version %s is older than %s", ErrUnsupported, version, min)
+	}
+	return nil
+}
+
+// versionNum returns the given version in the form used by the
+// server_version_num setting.
+func versionNum(version string) (int, error) {
+	parts := strings.Split(version, ".")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("invalid version %q", version)
+	}
+	nums := make([]int, 3)
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid version %q", version)
+		}
+		nums[i] = n
+	}
+	if nums[0] >= 10 {
+		// Since version 10, the second number is the minor version.
+		return nums[0]*10000 + nums[1], nil
+	}
+	return nums[0]*10000 + nums[1]*100 + nums[2], nil
+}
+
+// RequireExtensions makes sure that each of the named extensions is
+// installed and visible in the search path. It returns an error
+// matching ErrUnsupported if an extension is not available on the
+// server or the connecting role is not allowed to create it.
+//
+// Extensions are installed in a database, not a schema, so a missing
+// extension is created in the test schema and dropped along with it,
+// but until then it is installed for the whole database. A test using
+// another schema in the same database cannot see it, and
+// RequireExtensions returns an error rather than trying to create it
+// again. Extensions needed by tests that run concurrently against a
+// shared database should be installed beforehand, for example in the
+// public schema, or the tests should use NewDB. For a DB created by
+// NewConn, a missing extension is created in the default schema and
+// is not removed.
+func (pg *DB) RequireExtensions(names ...string) error {
+	for _, name := range names {
+		var available bool
+		err := pg.DB.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_available_extensions WHERE name = $1)`, name).Scan(&available)
+		if err != nil {
+			return fmt.Errorf("cannot check for extension %s: %w", name, err)
+		}
+		if !available {
+			return fmt.Errorf("%w: extension %s is not available", ErrUnsupported, name)
+		}
+		var schema string
+		var visible bool
+		err = pg.DB.QueryRow(`
+			SELECT n.nspname, n.nspname = ANY (current_schemas(true))
+			FROM pg_extension e
+			JOIN pg_namespace n ON n.oid = e.extnamespace
+			WHERE e.extname = $1`, name).Scan(&schema, &visible)
+		switch {
+		case err == nil && visible:
+			continue
+		case err == nil:
+			return fmt.Errorf("extension %s is installed in schema %s, which is not in the search path", name, schema)
+		case err != sql.ErrNoRows:
+			return fmt.Errorf("cannot check for extension %s: %w", name, err)
+		}
+		stmt := "CREATE EXTENSION IF NOT EXISTS " + pq.QuoteIdentifier(name)
+		if pg.schema != "" {
+			stmt += " SCHEMA " + pq.QuoteIdentifier(pg.schema)
+		}
+		_, err = pg.DB.Exec(stmt)
+		if SQLState(err) == "42501" {
+			// insufficient_privilege
+			return &unsupportedError{
+				msg:   "cannot create extension " + name,
+				cause: err,
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("cannot create extension %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// checkRequirements checks the requirements given by o.
+func (pg *DB) checkRequirements(o *options) error {
+	if o.minVersion != "" {
+		if err := pg.RequireVersion(o.minVersion); err != nil {
+			return err
+		}
+	}
+	if len(o.extensions) == 0 {
+		return nil
+	}
+	if !o.extensionsBestEffort {
+		return pg.RequireExtensions(o.extensions...)
+	}
+	for _, name := range o.extensions {
+		err := pg.RequireExtensions(name)
+		if errors.Is(err, ErrUnsupported) {
+			fmt.Fprintf(os.Stderr, "postgrestest: skipping extension: %v\n", err)
+			pg.skippedExtensions = append(pg.skippedExtensions, name)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SkippedExtensions returns the names of the extensions given to
+// WithExtensions that were not installed because they were not
+// available and WithExtensionsBestEffort was used, so that tests that
+// need them can skip.
+func (pg *DB) SkippedExtensions() []string {
+	return append([]string(nil), pg.skippedExtensions...)
+}
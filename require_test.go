@@ -0,0 +1,88 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest_test
+
+import (
+	"errors"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/postgrestest"
+)
+
+func TestRequireVersion(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+
+	c.Assert(db.RequireVersion("9.0"), qt.Equals, nil)
+	err = db.RequireVersion("999.1")
+	c.Assert(err, qt.ErrorMatches, `unsupported by postgres server: server version .* is older than 999.1`)
+	c.Assert(errors.Is(err, postgrestest.ErrUnsupported), qt.Equals, true)
+	c.Assert(db.RequireVersion("nine"), qt.ErrorMatches, `invalid version "nine"`)
+}
+
+func TestRequireExtensions(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+
+	// plpgsql is always installed.
+	c.Assert(db.RequireExtensions("plpgsql"), qt.Equals, nil)
+	err = db.RequireExtensions("plpgsql", "nosuchextension")
+	c.Assert(err, qt.ErrorMatches, `unsupported by postgres server: extension nosuchextension is not available`)
+	c.Assert(errors.Is(err, postgrestest.ErrUnsupported), qt.Equals, true)
+}
+
+func TestRequireExtensionsOtherSchema(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+	err = db.RequireExtensions("pg_trgm")
+	if errors.Is(err, postgrestest.ErrUnsupported) {
+		c.Skip(err)
+	}
+	c.Assert(err, qt.Equals, nil)
+	var schema string
+	err = db.QueryRow(`SELECT extnamespace::regnamespace::text FROM pg_extension WHERE extname = 'pg_trgm'`).Scan(&schema)
+	c.Assert(err, qt.Equals, nil)
+	if schema != db.Schema() {
+		c.Skip("pg_trgm is already installed in schema ", schema)
+	}
+
+	// The extension is installed for the whole database, but
+	// another test schema cannot see it.
+	other, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer other.Close()
+	err = other.RequireExtensions("pg_trgm")
+	c.Assert(err, qt.ErrorMatches, `extension pg_trgm is installed in schema `+db.Schema()+`, which is not in the search path`)
+}
+
+func TestNewForTestUnsupported(t *testing.T) {
+	c := qt.New(t)
+	var skipped bool
+	t.Run("sub", func(t *testing.T) {
+		defer func() {
+			skipped = t.Skipped()
+		}()
+		postgrestest.NewForTest(t, postgrestest.WithMinVersion("999"))
+		t.Error("NewForTest returned when the server is too old")
+	})
+	c.Assert(skipped, qt.Equals, true)
+}
+
+func TestWithExtensionsBestEffort(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.NewWithOptions(
+		postgrestest.WithExtensions("plpgsql", "nosuchextension"),
+		postgrestest.WithExtensionsBestEffort(),
+	)
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+	c.Assert(db.SkippedExtensions(), qt.DeepEquals, []string{"nosuchextension"})
+}
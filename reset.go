@@ -0,0 +1,41 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Reset removes all the data from the tables in the test schema
+// without changing the schema's structure, so that it can be reused
+// by another test case without applying migrations again. All tables
+// are truncated with RESTART IDENTITY, so sequences owned by their
+// columns (for example by serial columns) start again from the
+// beginning. Sequences not owned by a column are left unchanged.
+//
+// As with Close, Reset gives up after a timeout if a lock prevents
+// the tables from being truncated. It does nothing if the schema has
+// no tables.
+func (pg *DB) Reset() error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+	return runWithContext(ctx, func(ctx context.Context) error {
+		tables, err := pg.Tables()
+		if err != nil {
+			return err
+		}
+		if len(tables) == 0 {
+			return nil
+		}
+		for i, table := range tables {
+			tables[i] = pq.QuoteIdentifier(pg.schema) + "." + pq.QuoteIdentifier(table)
+		}
+		_, err = pg.DB.ExecContext(ctx, fmt.Sprintf("TRUNCATE %s RESTART IDENTITY CASCADE", strings.Join(tables, ", ")))
+		return err
+	}, "reset test schema "+pg.schema)
+}
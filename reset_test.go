@@ -0,0 +1,44 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest_test
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/postgrestest"
+)
+
+func TestReset(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+
+	// Reset is fine with an empty schema.
+	err = db.Reset()
+	c.Assert(err, qt.Equals, nil)
+
+	_, err = db.Exec(`
+		CREATE TABLE x (id serial PRIMARY KEY, val text);
+		CREATE TABLE y (x_id integer REFERENCES x (id));
+		INSERT INTO x (val) VALUES ('a'), ('b');
+		INSERT INTO y VALUES (1);
+	`)
+	c.Assert(err, qt.Equals, nil)
+	err = db.Reset()
+	c.Assert(err, qt.Equals, nil)
+	db.AssertTables(t, []string{"x", "y"})
+
+	var count int
+	err = db.QueryRow(`SELECT (SELECT COUNT(*) FROM x) + (SELECT COUNT(*) FROM y)`).Scan(&count)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(count, qt.Equals, 0)
+
+	// The sequence should start again from the beginning.
+	var id int
+	err = db.QueryRow(`INSERT INTO x (val) VALUES ('c') RETURNING id`).Scan(&id)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(id, qt.Equals, 1)
+}
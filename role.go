@@ -0,0 +1,204 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// NewRole creates a role with a random name that has the given
+// privileges (for example "SELECT" or "INSERT, UPDATE") on all tables
+// in the test schema, including ones created later, and usage of its
+// sequences. It returns the name of the role, for use in policies and
+// further GRANT statements, and a database handle whose connections
+// act as that role. This is useful for testing row-level security and
+// privilege checks as a role that is not a superuser.
+//
+// The connecting role needs the CREATEROLE privilege. The returned
+// handle is closed, and the role dropped, when pg is closed.
+func (pg *DB) NewRole(privileges ...string) (string, *sql.DB, error) {
+	if pg.schema == "" {
+		return "", nil, errors.New("cannot create role: no test schema")
+	}
+	name := randomName("go_test_role_")
+	role := pq.QuoteIdentifier(name)
+	schema := pq.QuoteIdentifier(pg.schema)
+	stmts := []string{
+		"CREATE ROLE " + role + " NOLOGIN",
+		// Membership allows our connections to act as the role.
+		"GRANT " + role + " TO CURRENT_USER",
+	}
+	stmts = append(stmts, schemaGrants(schema, role, privileges)...)
+	err := runWithTimeout(func(done chan error) {
+		done <- pg.execInTx(stmts)
+	}, defaultTimeout, "create role "+name)
+	if err != nil {
+		return "", nil, err
+	}
+
+	params, err := parseConnString(pg.dataSource)
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot parse connection string: %w", err)
+	}
+	params["options"] = strings.TrimSpace(pg.params["options"] + " -c role=" + name)
+	db, err := sql.Open(pg.driverName, connString(params))
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot open database: %w", err)
+	}
+	pg.closeMu.Lock()
+	defer pg.closeMu.Unlock()
+	pg.roles = append(pg.roles, name)
+	pg.extra = append(pg.extra, db)
+	return name, db, nil
+}
+
+// Grant describes privileges in the test schema that WithGrants gives
+// to an existing role.
+type Grant struct {
+	// Role holds the name of the role.
+	Role string
+	// Privileges holds the privileges the role is given on all
+	// tables in the schema, including ones created later, for
+	// example "SELECT" or "INSERT". The role is always given usage
+	// of the schema and its sequences.
+	Privileges []string
+}
+
+// privilegePattern matches the table privileges accepted in a Grant.
+var privilegePattern = regexp.MustCompile(`(?i)^(SELECT|INSERT|UPDATE|DELETE|TRUNCATE|REFERENCES|TRIGGER|ALL|ALL PRIVILEGES)$`)
+
+// applyGrants gives the privileges described by grants to their roles,
+// failing if any of the roles does not exist.
+func (pg *DB) applyGrants(grants []Grant) error {
+	schema := pq.QuoteIdentifier(pg.schema)
+	var stmts []string
+	for _, g := range grants {
+		var exists bool
+		err := pg.DB.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = $1)`, g.Role).Scan(&exists)
+		if err != nil {
+			return fmt.Errorf("cannot check role %q: %w", g.Role, err)
+		}
+		if !exists {
+			return fmt.Errorf("cannot grant privileges: role %q does not exist", g.Role)
+		}
+		stmts = append(stmts, schemaGrants(schema, pq.QuoteIdentifier(g.Role), g.Privileges)...)
+	}
+	return runWithTimeout(func(done chan error) {
+		done <- pg.execInTx(stmts)
+	}, pg.opTimeout(), "grant privileges")
+}
+
+// RoleSpec describes a role that WithRoles creates if it does not
+// already exist.
+type RoleSpec struct {
+	// Name holds the name of the role.
+	Name string
+	// Attributes holds the attributes the role is created with, for
+	// example "LOGIN" or "CREATEDB". They are not changed if the
+	// role already exists.
+	Attributes []string
+	// Privileges holds the privileges the role is given in the
+	// test schema, as for Grant.
+	Privileges []string
+}
+
+// attributePattern matches the role attributes accepted in a RoleSpec.
+var attributePattern = regexp.MustCompile(`(?i)^(NO)?(SUPERUSER|CREATEDB|CREATEROLE|INHERIT|LOGIN|REPLICATION|BYPASSRLS)$`)
+
+// createRoles creates those of the given roles that do not already
+// exist, recording them so that they are dropped when pg is closed,
+// and then gives all of them their privileges in the test schema.
+func (pg *DB) createRoles(specs []RoleSpec) error {
+	grants := make([]Grant, len(specs))
+	for i, spec := range specs {
+		if err := pg.createRole(spec); err != nil {
+			return err
+		}
+		grants[i] = Grant{Role: spec.Name, Privileges: spec.Privileges}
+	}
+	return pg.applyGrants(grants)
+}
+
+// createRole creates the given role unless it already exists.
+func (pg *DB) createRole(spec RoleSpec) error {
+	role := pq.QuoteIdentifier(spec.Name)
+	create := "CREATE ROLE " + role
+	if len(spec.Attributes) > 0 {
+		create += " " + strings.Join(spec.Attributes, " ")
+	}
+	return runWithTimeout(func(done chan error) {
+		_, err := pg.DB.Exec(create)
+		if SQLState(err) == "42710" {
+			// The role already exists and may be shared with
+			// other tests, so it is not dropped on Close.
+			done <- nil
+			return
+		}
+		if err != nil {
+			done <- err
+			return
+		}
+		pg.closeMu.Lock()
+		pg.roles = append(pg.roles, spec.Name)
+		pg.closeMu.Unlock()
+		// Membership allows our connections to act as the role.
+		_, err = pg.DB.Exec("GRANT " + role + " TO CURRENT_USER")
+		done <- err
+	}, pg.opTimeout(), "create role "+spec.Name)
+}
+
+// schemaGrants returns the statements that give the given quoted role
+// usage of the given quoted schema and its sequences, and the given
+// privileges on its tables, including ones created later.
+func schemaGrants(schema, role string, privileges []string) []string {
+	stmts := []string{
+		"GRANT USAGE ON SCHEMA " + schema + " TO " + role,
+		"GRANT USAGE ON ALL SEQUENCES IN SCHEMA " + schema + " TO " + role,
+		"ALTER DEFAULT PRIVILEGES IN SCHEMA " + schema + " GRANT USAGE ON SEQUENCES TO " + role,
+	}
+	if len(privileges) > 0 {
+		privs := strings.Join(privileges, ", ")
+		stmts = append(stmts,
+			"GRANT "+privs+" ON ALL TABLES IN SCHEMA "+schema+" TO "+role,
+			"ALTER DEFAULT PRIVILEGES IN SCHEMA "+schema+" GRANT "+privs+" ON TABLES TO "+role,
+		)
+	}
+	return stmts
+}
+
+// execInTx executes the given statements in a single transaction.
+func (pg *DB) execInTx(stmts []string) error {
+	tx, err := pg.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// dropRoles drops the given roles, along with any privileges granted
+// to them.
+func (pg *DB) dropRoles(ctx context.Context, roles []string) error {
+	for _, role := range roles {
+		role := pq.QuoteIdentifier(role)
+		for _, stmt := range []string{"DROP OWNED BY " + role, "DROP ROLE IF EXISTS " + role} {
+			if _, err := pg.DB.ExecContext(ctx, stmt); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
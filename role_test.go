@@ -0,0 +1,149 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest_test
+
+import (
+	"database/sql"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/postgrestest"
+)
+
+func TestNewRole(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	skipUnlessSuperuser(c, db)
+	_, err = db.Exec(`CREATE TABLE x (id serial, val text); INSERT INTO x (val) VALUES ('a')`)
+	c.Assert(err, qt.Equals, nil)
+
+	role, rdb, err := db.NewRole("SELECT")
+	c.Assert(err, qt.Equals, nil)
+	var user string
+	err = rdb.QueryRow(`SELECT current_user`).Scan(&user)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(user, qt.Equals, role)
+
+	// The role can read but not write.
+	var val string
+	err = rdb.QueryRow(`SELECT val FROM x`).Scan(&val)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(val, qt.Equals, "a")
+	_, err = rdb.Exec(`INSERT INTO x (val) VALUES ('b')`)
+	c.Assert(err, qt.ErrorMatches, `.*permission denied.*`)
+
+	// Privileges extend to tables created later.
+	_, err = db.Exec(`CREATE TABLE y (id integer)`)
+	c.Assert(err, qt.Equals, nil)
+	_, err = rdb.Exec(`SELECT * FROM y`)
+	c.Assert(err, qt.Equals, nil)
+
+	c.Assert(db.Close(), qt.Equals, nil)
+	sdb, err := sql.Open("postgres", "")
+	c.Assert(err, qt.Equals, nil)
+	defer sdb.Close()
+	var count int
+	err = sdb.QueryRow(`SELECT COUNT(*) FROM pg_roles WHERE rolname = $1`, role).Scan(&count)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(count, qt.Equals, 0)
+}
+
+func TestWithGrants(t *testing.T) {
+	c := qt.New(t)
+	admin, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer admin.Close()
+	skipUnlessSuperuser(c, admin)
+	_, err = admin.Exec(`CREATE ROLE go_test_grant_reader NOLOGIN`)
+	c.Assert(err, qt.Equals, nil)
+	defer admin.Exec(`DROP ROLE go_test_grant_reader`)
+
+	db, err := postgrestest.NewWithOptions(
+		postgrestest.WithGrants(postgrestest.Grant{
+			Role:       "go_test_grant_reader",
+			Privileges: []string{"SELECT"},
+		}),
+		postgrestest.WithSchemaSQL(`CREATE TABLE x (id serial)`),
+	)
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+	var canSelect, canInsert, canUseSeq bool
+	err = db.QueryRow(`
+		SELECT has_table_privilege('go_test_grant_reader', 'x', 'SELECT'),
+			has_table_privilege('go_test_grant_reader', 'x', 'INSERT'),
+			has_sequence_privilege('go_test_grant_reader', 'x_id_seq', 'USAGE')
+	`).Scan(&canSelect, &canInsert, &canUseSeq)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(canSelect, qt.Equals, true)
+	c.Assert(canInsert, qt.Equals, false)
+	c.Assert(canUseSeq, qt.Equals, true)
+}
+
+func TestWithGrantsNoRole(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.NewWithOptions(
+		postgrestest.WithGrants(postgrestest.Grant{Role: "go_test_no_such_role"}),
+	)
+	c.Assert(err, qt.ErrorMatches, `cannot grant privileges: role "go_test_no_such_role" does not exist`)
+	c.Assert(db, qt.IsNil)
+}
+
+func TestWithRoles(t *testing.T) {
+	c := qt.New(t)
+	admin, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer admin.Close()
+	skipUnlessSuperuser(c, admin)
+	_, err = admin.Exec(`CREATE ROLE go_test_shared_role NOLOGIN`)
+	c.Assert(err, qt.Equals, nil)
+	defer admin.Exec(`DROP ROLE go_test_shared_role`)
+
+	db, err := postgrestest.NewWithOptions(
+		postgrestest.WithRoles(postgrestest.RoleSpec{
+			Name:       "go_test_app_role",
+			Attributes: []string{"LOGIN"},
+			Privileges: []string{"SELECT", "INSERT"},
+		}, postgrestest.RoleSpec{
+			Name:       "go_test_shared_role",
+			Privileges: []string{"SELECT"},
+		}),
+		postgrestest.WithSchemaSQL(`CREATE TABLE x (id integer)`),
+	)
+	c.Assert(err, qt.Equals, nil)
+	var canLogin, appInsert, sharedInsert bool
+	err = db.QueryRow(`
+		SELECT (SELECT rolcanlogin FROM pg_roles WHERE rolname = 'go_test_app_role'),
+			has_table_privilege('go_test_app_role', 'x', 'INSERT'),
+			has_table_privilege('go_test_shared_role', 'x', 'INSERT')
+	`).Scan(&canLogin, &appInsert, &sharedInsert)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(canLogin, qt.Equals, true)
+	c.Assert(appInsert, qt.Equals, true)
+	c.Assert(sharedInsert, qt.Equals, false)
+
+	// Connections can act as the roles that were created.
+	tx, err := db.Begin()
+	c.Assert(err, qt.Equals, nil)
+	defer tx.Rollback()
+	_, err = tx.Exec(`SET LOCAL ROLE go_test_app_role`)
+	c.Assert(err, qt.Equals, nil)
+	_, err = tx.Exec(`INSERT INTO x VALUES (1)`)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(tx.Rollback(), qt.Equals, nil)
+
+	// Only the role that was created is dropped.
+	c.Assert(db.Close(), qt.Equals, nil)
+	var roles []string
+	rows, err := admin.Query(`SELECT rolname FROM pg_roles WHERE rolname IN ('go_test_app_role', 'go_test_shared_role')`)
+	c.Assert(err, qt.Equals, nil)
+	defer rows.Close()
+	for rows.Next() {
+		var role string
+		c.Assert(rows.Scan(&role), qt.Equals, nil)
+		roles = append(roles, role)
+	}
+	c.Assert(rows.Err(), qt.Equals, nil)
+	c.Assert(roles, qt.DeepEquals, []string{"go_test_shared_role"})
+}
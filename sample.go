@@ -0,0 +1,40 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest
+
+import (
+	"embed"
+	"fmt"
+)
+
+//go:embed sampledata/sample.sql
+var sampleData embed.FS
+
+// NewWithSampleData is like New except that the test schema is
+// populated with a small sample dataset, which is useful for
+// experimenting and for examples. The dataset holds these tables:
+//
+//	users (id, name, email) - 3 users; Carol has no orders.
+//	items (id, name, price_cents) - 3 items.
+//	orders (id, user_id, created_at) - 3 orders, 2 of them Alice's.
+//	order_items (order_id, item_id, quantity) - 6 order lines.
+//
+// See sampledata/sample.sql for the exact definitions and data.
+func NewWithSampleData() (*DB, error) {
+	db, err := New()
+	if err != nil {
+		return nil, err
+	}
+	f, err := sampleData.Open("sampledata/sample.sql")
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot open sample data: %w", err)
+	}
+	defer f.Close()
+	if err := db.LoadSQL(f); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot load sample data: %w", err)
+	}
+	return db, nil
+}
@@ -0,0 +1,29 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest_test
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/postgrestest"
+)
+
+func TestNewWithSampleData(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.NewWithSampleData()
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+
+	db.AssertTables(t, []string{"items", "order_items", "orders", "users"})
+	var total int
+	err = db.QueryRow(`
+		SELECT SUM(oi.quantity * i.price_cents)
+		FROM orders o
+		JOIN order_items oi ON oi.order_id = o.id
+		JOIN items i ON i.id = oi.item_id
+		WHERE o.user_id = 1`).Scan(&total)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(total, qt.Equals, 6*50+250+800)
+}
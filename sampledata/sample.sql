@@ -0,0 +1,50 @@
+-- Sample dataset used by NewWithSampleData.
+-- Keep this small: it is loaded for every DB that uses it.
+
+CREATE TABLE users (
+	id integer PRIMARY KEY,
+	name text NOT NULL,
+	email text NOT NULL UNIQUE
+);
+
+CREATE TABLE items (
+	id integer PRIMARY KEY,
+	name text NOT NULL,
+	price_cents integer NOT NULL
+);
+
+CREATE TABLE orders (
+	id integer PRIMARY KEY,
+	user_id integer NOT NULL REFERENCES users (id),
+	created_at timestamp with time zone NOT NULL
+);
+
+CREATE TABLE order_items (
+	order_id integer NOT NULL REFERENCES orders (id),
+	item_id integer NOT NULL REFERENCES items (id),
+	quantity integer NOT NULL,
+	PRIMARY KEY (order_id, item_id)
+);
+
+INSERT INTO users (id, name, email) VALUES
+	(1, 'Alice', 'alice@example.com'),
+	(2, 'Bob', 'bob@example.com'),
+	(3, 'Carol', 'carol@example.com');
+
+INSERT INTO items (id, name, price_cents) VALUES
+	(1, 'apple', 50),
+	(2, 'bread', 250),
+	(3, 'cheese', 800);
+
+INSERT INTO orders (id, user_id, created_at) VALUES
+	(1, 1, '2017-01-02 10:00:00+00'),
+	(2, 1, '2017-01-05 16:30:00+00'),
+	(3, 2, '2017-01-06 09:15:00+00');
+
+INSERT INTO order_items (order_id, item_id, quantity) VALUES
+	(1, 1, 6),
+	(1, 2, 1),
+	(2, 3, 1),
+	(3, 1, 2),
+	(3, 2, 2),
+	(3, 3, 1);
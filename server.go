@@ -0,0 +1,18 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest
+
+// Checkpoint forces a write-ahead log checkpoint, flushing all
+// dirty buffers to disk. This can be used to stabilize write-heavy
+// benchmarks by controlling when the flush happens.
+//
+// Note that a checkpoint affects the whole cluster, not just the
+// test schema, and that the connecting role must be a superuser
+// (or, from Postgres 15, have the pg_checkpoint role).
+func (pg *DB) Checkpoint() error {
+	return runWithTimeout(func(done chan error) {
+		_, err := pg.DB.Exec(`CHECKPOINT`)
+		done <- err
+	}, defaultTimeout, "checkpoint")
+}
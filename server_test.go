@@ -0,0 +1,24 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest_test
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/postgrestest"
+)
+
+func TestCheckpoint(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+	skipUnlessSuperuser(c, db)
+
+	_, err = db.Exec(`CREATE TABLE x (id integer); INSERT INTO x SELECT generate_series(1, 1000)`)
+	c.Assert(err, qt.Equals, nil)
+	err = db.Checkpoint()
+	c.Assert(err, qt.Equals, nil)
+}
@@ -0,0 +1,351 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// dataSnapshot holds the state recorded by Snapshot.
+type dataSnapshot struct {
+	// schema holds the name of the schema that holds copies of
+	// the tables.
+	schema    string
+	tables    []snapshotTable
+	sequences []sequenceState
+}
+
+// snapshotTable holds a table copied by Snapshot.
+type snapshotTable struct {
+	name string
+	// columns holds the columns that were copied, which excludes
+	// generated columns.
+	columns []string
+	// identity holds whether the table has an identity column.
+	identity bool
+}
+
+// sequenceState holds the state of a sequence recorded by Snapshot.
+type sequenceState struct {
+	name   string
+	value  int64
+	called bool
+}
+
+// Snapshot records the contents of all the tables in the test schema,
+// and the values of its sequences, under the given name, so that they
+// can be restored later by Restore. This allows several tests to share
+// expensive setup: set up the data, take a snapshot and restore it at
+// the start of each test. Taking a snapshot with an existing name
+// replaces it.
+//
+// The data is copied to another schema, which is dropped when the DB
+// is closed. Only the data is recorded, not the structure of the
+// schema. Taking and restoring snapshots are subject to the timeout
+// set by WithTimeout.
+func (pg *DB) Snapshot(name string) error {
+	if pg.schema == "" {
+		return errors.New("cannot take snapshot: no test schema")
+	}
+	snap := &dataSnapshot{
+		schema: randomName("go_test_snap_"),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pg.opTimeout())
+	defer cancel()
+	err := runWithContext(ctx, func(ctx context.Context) error {
+		return pg.takeSnapshot(ctx, snap)
+	}, "take snapshot "+name)
+	if err != nil {
+		// The copy may have been cut short by the timeout, so make
+		// sure that none of it is left behind.
+		dropCtx, dropCancel := context.WithTimeout(context.Background(), defaultTimeout)
+		defer dropCancel()
+		if errDrop := runWithContext(dropCtx, snap.drop(pg.DB), "drop snapshot "+name); errDrop != nil {
+			fmt.Fprintf(os.Stderr, "postgrestest: %v\n", errDrop)
+		}
+		return err
+	}
+	pg.closeMu.Lock()
+	old := pg.dataSnapshots[name]
+	if pg.dataSnapshots == nil {
+		pg.dataSnapshots = make(map[string]*dataSnapshot)
+	}
+	pg.dataSnapshots[name] = snap
+	pg.closeMu.Unlock()
+	if old != nil {
+		return runWithContext(ctx, old.drop(pg.DB), "drop old snapshot "+name)
+	}
+	return nil
+}
+
+// takeSnapshot copies the tables and sequence values into snap.
+func (pg *DB) takeSnapshot(ctx context.Context, snap *dataSnapshot) error {
+	// Use a single consistent view of the data.
+	tx, err := pg.DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	shadow := pq.QuoteIdentifier(snap.schema)
+	// Record the creation time so that CleanupStale can find the
+	// schema if it is never dropped.
+	if _, err := tx.ExecContext(ctx, "CREATE SCHEMA "+shadow+"; COMMENT ON SCHEMA "+shadow+" IS "+createdComment()); err != nil {
+		return err
+	}
+	snap.tables, err = snapshotTables(ctx, tx, pg.schema)
+	if err != nil {
+		return err
+	}
+	for _, table := range snap.tables {
+		_, err := tx.ExecContext(ctx, fmt.Sprintf("CREATE TABLE %s.%s AS SELECT %s FROM ONLY %s.%s",
+			shadow, pq.QuoteIdentifier(table.name),
+			quoteIdentifiers(table.columns),
+			pq.QuoteIdentifier(pg.schema), pq.QuoteIdentifier(table.name),
+		))
+		if err != nil {
+			return fmt.Errorf("cannot copy table %s: %w", table.name, err)
+		}
+	}
+	snap.sequences, err = sequenceStates(ctx, tx, pg.schema)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Restore restores the contents of the tables in the test schema, and
+// the values of its sequences, to those recorded by Snapshot under
+// the given name. Tables created since the snapshot was taken are
+// emptied.
+//
+// The tables are restored in a single transaction, in an order that
+// satisfies foreign key constraints between them, with deferrable
+// constraints deferred. Tables with circular references that are not
+// deferrable cannot be restored.
+func (pg *DB) Restore(name string) error {
+	pg.closeMu.Lock()
+	snap := pg.dataSnapshots[name]
+	pg.closeMu.Unlock()
+	if snap == nil {
+		return fmt.Errorf("cannot restore snapshot: no snapshot named %q", name)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pg.opTimeout())
+	defer cancel()
+	return runWithContext(ctx, func(ctx context.Context) error {
+		return pg.restoreSnapshot(ctx, snap)
+	}, "restore snapshot "+name)
+}
+
+// restoreSnapshot restores the data recorded in snap.
+func (pg *DB) restoreSnapshot(ctx context.Context, snap *dataSnapshot) error {
+	tables, err := pg.Tables()
+	if err != nil {
+		return err
+	}
+	tx, err := pg.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	schema := pq.QuoteIdentifier(pg.schema)
+	if len(tables) > 0 {
+		for i, table := range tables {
+			tables[i] = schema + "." + pq.QuoteIdentifier(table)
+		}
+		if _, err := tx.ExecContext(ctx, "TRUNCATE "+strings.Join(tables, ", ")+" RESTART IDENTITY CASCADE"); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "SET CONSTRAINTS ALL DEFERRED"); err != nil {
+		return err
+	}
+	ordered, err := foreignKeyOrder(ctx, tx, pg.schema, snap.tables)
+	if err != nil {
+		return err
+	}
+	for _, table := range ordered {
+		overriding := ""
+		if table.identity {
+			overriding = " OVERRIDING SYSTEM VALUE"
+		}
+		columns := quoteIdentifiers(table.columns)
+		_, err := tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s.%s (%s)%s SELECT %s FROM %s.%s",
+			schema, pq.QuoteIdentifier(table.name), columns, overriding,
+			columns, pq.QuoteIdentifier(snap.schema), pq.QuoteIdentifier(table.name),
+		))
+		if err != nil {
+			return fmt.Errorf("cannot restore table %s: %w", table.name, err)
+		}
+	}
+	for _, seq := range snap.sequences {
+		_, err := tx.ExecContext(ctx, `SELECT setval($1::regclass, $2, $3)`, schema+"."+pq.QuoteIdentifier(seq.name), seq.value, seq.called)
+		if err != nil {
+			return fmt.Errorf("cannot restore sequence %s: %w", seq.name, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// drop returns a function that drops the schema holding the snapshot.
+func (snap *dataSnapshot) drop(db *sql.DB) func(context.Context) error {
+	return func(ctx context.Context) error {
+		_, err := db.ExecContext(ctx, "DROP SCHEMA IF EXISTS "+pq.QuoteIdentifier(snap.schema)+" CASCADE")
+		return err
+	}
+}
+
+// snapshotTables returns the tables in the given schema along with the
+// columns to copy from each. Partitioned tables hold no rows of their
+// own, so they are left out in favour of their partitions.
+func snapshotTables(ctx context.Context, tx *sql.Tx, schema string) ([]snapshotTable, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT c.table_name, c.column_name, c.is_identity = 'YES'
+		FROM information_schema.columns c
+		JOIN pg_class r
+			ON r.relnamespace = $2::regnamespace AND r.relname = c.table_name
+		WHERE c.table_schema = $1 AND r.relkind = 'r' AND c.is_generated = 'NEVER'
+		ORDER BY c.table_name, c.ordinal_position`, schema, pq.QuoteIdentifier(schema))
+	if err != nil {
+		return nil, fmt.Errorf("cannot query tables: %w", err)
+	}
+	defer rows.Close()
+	var tables []snapshotTable
+	for rows.Next() {
+		var table, column string
+		var identity bool
+		if err := rows.Scan(&table, &column, &identity); err != nil {
+			return nil, fmt.Errorf("cannot scan tables: %w", err)
+		}
+		if len(tables) == 0 || tables[len(tables)-1].name != table {
+			tables = append(tables, snapshotTable{name: table})
+		}
+		t := &tables[len(tables)-1]
+		t.columns = append(t.columns, column)
+		t.identity = t.identity || identity
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot query tables: %w", err)
+	}
+	return tables, nil
+}
+
+// sequenceStates returns the state of all the sequences in the given
+// schema.
+func sequenceStates(ctx context.Context, tx *sql.Tx, schema string) ([]sequenceState, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT relname FROM pg_class
+		WHERE relkind = 'S' AND relnamespace = $1::regnamespace
+		ORDER BY 1`, pq.QuoteIdentifier(schema))
+	if err != nil {
+		return nil, fmt.Errorf("cannot query sequences: %w", err)
+	}
+	var seqs []sequenceState
+	for rows.Next() {
+		var seq sequenceState
+		if err := rows.Scan(&seq.name); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("cannot scan sequences: %w", err)
+		}
+		seqs = append(seqs, seq)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot query sequences: %w", err)
+	}
+	for i := range seqs {
+		seq := &seqs[i]
+		err := tx.QueryRowContext(ctx, fmt.Sprintf("SELECT last_value, is_called FROM %s.%s",
+			pq.QuoteIdentifier(schema), pq.QuoteIdentifier(seq.name),
+		)).Scan(&seq.value, &seq.called)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read sequence %s: %w", seq.name, err)
+		}
+	}
+	return seqs, nil
+}
+
+// foreignKeyOrder returns the given tables ordered so that each table
+// comes after the tables it references, as far as possible.
+func foreignKeyOrder(ctx context.Context, tx *sql.Tx, schema string, tables []snapshotTable) ([]snapshotTable, error) {
+	rows, err := tx.QueryContext(ctx, `
+		SELECT DISTINCT t.relname, r.relname
+		FROM pg_constraint c
+		JOIN pg_class t ON t.oid = c.conrelid
+		JOIN pg_class r ON r.oid = c.confrelid
+		WHERE c.contype = 'f' AND c.conrelid <> c.confrelid
+			AND t.relnamespace = $1::regnamespace
+			AND r.relnamespace = $1::regnamespace`, pq.QuoteIdentifier(schema))
+	if err != nil {
+		return nil, fmt.Errorf("cannot query foreign keys: %w", err)
+	}
+	defer rows.Close()
+	refs := make(map[string][]string)
+	for rows.Next() {
+		var table, ref string
+		if err := rows.Scan(&table, &ref); err != nil {
+			return nil, fmt.Errorf("cannot scan foreign keys: %w", err)
+		}
+		refs[table] = append(refs[table], ref)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot query foreign keys: %w", err)
+	}
+
+	// done holds whether each table has been ordered yet.
+	done := make(map[string]bool)
+	for _, table := range tables {
+		done[table.name] = false
+	}
+	ordered := make([]snapshotTable, 0, len(tables))
+	for len(ordered) < len(tables) {
+		progress := false
+		for _, table := range tables {
+			if done[table.name] || !refsDone(refs[table.name], done) {
+				continue
+			}
+			done[table.name] = true
+			ordered = append(ordered, table)
+			progress = true
+		}
+		if !progress {
+			// There is a cycle; add the remaining tables in
+			// order and rely on deferred constraints.
+			for _, table := range tables {
+				if !done[table.name] {
+					done[table.name] = true
+					ordered = append(ordered, table)
+				}
+			}
+		}
+	}
+	return ordered, nil
+}
+
+// refsDone reports whether none of the given tables is waiting to be
+// ordered. Tables that are not being restored do not count.
+func refsDone(refs []string, done map[string]bool) bool {
+	for _, ref := range refs {
+		if d, ok := done[ref]; ok && !d {
+			return false
+		}
+	}
+	return true
+}
+
+// quoteIdentifiers returns a comma-separated list of the given
+// identifiers, quoted.
+func quoteIdentifiers(names []string) string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = pq.QuoteIdentifier(name)
+	}
+	return strings.Join(quoted, ", ")
+}
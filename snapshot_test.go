@@ -0,0 +1,59 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest_test
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/postgrestest"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+	_, err = db.Exec(`
+		CREATE TABLE users (id serial PRIMARY KEY, name text);
+		-- The name sorts before users, so it must be restored second.
+		CREATE TABLE orders (id serial PRIMARY KEY, user_id integer NOT NULL REFERENCES users (id));
+		INSERT INTO users (name) VALUES ('alice'), ('bob');
+		INSERT INTO orders (user_id) VALUES (1);
+		CREATE TABLE events (kind text NOT NULL, val text) PARTITION BY LIST (kind);
+		CREATE TABLE events_a PARTITION OF events FOR VALUES IN ('a');
+		CREATE TABLE events_b PARTITION OF events FOR VALUES IN ('b');
+		INSERT INTO events VALUES ('a', 'x'), ('b', 'y');
+	`)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(db.Snapshot("base"), qt.Equals, nil)
+
+	for _, name := range []string{"one", "two"} {
+		t.Run(name, func(t *testing.T) {
+			c := qt.New(t)
+			c.Assert(db.Restore("base"), qt.Equals, nil)
+			var count int
+			err := db.QueryRow(`SELECT COUNT(*) FROM users`).Scan(&count)
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(count, qt.Equals, 2)
+			// The sequence continues from where it was.
+			var id int
+			err = db.QueryRow(`INSERT INTO users (name) VALUES ('carol') RETURNING id`).Scan(&id)
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(id, qt.Equals, 3)
+			_, err = db.Exec(`DELETE FROM orders`)
+			c.Assert(err, qt.Equals, nil)
+			// Rows of a partitioned table are restored once, through
+			// its partitions.
+			err = db.QueryRow(`SELECT COUNT(*) FROM events`).Scan(&count)
+			c.Assert(err, qt.Equals, nil)
+			c.Assert(count, qt.Equals, 2)
+			_, err = db.Exec(`INSERT INTO events VALUES ('a', 'z')`)
+			c.Assert(err, qt.Equals, nil)
+		})
+	}
+
+	err = db.Restore("other")
+	c.Assert(err, qt.ErrorMatches, `cannot restore snapshot: no snapshot named "other"`)
+}
@@ -0,0 +1,154 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// createdCommentPrefix prefixes the comment recording when a test
+// schema or database was created.
+const createdCommentPrefix = "postgrestest: created "
+
+// createdComment returns the comment recording that a test schema or
+// database was created now. The result is a quoted SQL literal.
+func createdComment() string {
+	return "'" + createdCommentPrefix + time.Now().UTC().Format(time.RFC3339) + "'"
+}
+
+// parseCreatedComment returns the creation time recorded in the given
+// comment, and whether the comment is one set by createdComment.
+func parseCreatedComment(comment string) (time.Time, bool) {
+	if !strings.HasPrefix(comment, createdCommentPrefix) {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, strings.TrimPrefix(comment, createdCommentPrefix))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// CleanupStale drops test schemas and databases that were created
+// more than olderThan ago and never dropped, for example because the
+// test process was killed. It returns the names of the schemas and
+// databases that were dropped.
+//
+// Test schemas and databases are recognised by a comment recording
+// when they were created, so ones created by older versions of this
+// package, and templates created by NewTemplate, are not dropped.
+// Schemas are only looked for in the database named by the PG*
+// environment variables, or by the connection parameters given to
+// NewWithOptions when called by WithStaleCleanup. A schema that is
+// locked by another session or a database that has active connections
+// is assumed to be still in use and is left alone. A test that is idle
+// holds no locks, so olderThan should be comfortably longer than the
+// longest test run.
+func CleanupStale(ctx context.Context, olderThan time.Duration) ([]string, error) {
+	return cleanupStale(ctx, "postgres", "", olderThan)
+}
+
+// cleanupStale implements CleanupStale, connecting with the given
+// driver and data source.
+func cleanupStale(ctx context.Context, driverName, dataSource string, olderThan time.Duration) ([]string, error) {
+	db, err := sql.Open(driverName, dataSource)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open database: %w", err)
+	}
+	defer db.Close()
+	cutoff := time.Now().Add(-olderThan)
+	schemas, err := staleObjects(ctx, db, `
+		SELECT nspname, obj_description(oid, 'pg_namespace')
+		FROM pg_namespace`, cutoff)
+	if err != nil {
+		return nil, fmt.Errorf("cannot find stale test schemas: %w", err)
+	}
+	databases, err := staleObjects(ctx, db, `
+		SELECT datname, shobj_description(oid, 'pg_database')
+		FROM pg_database
+		WHERE NOT EXISTS (
+			SELECT 1 FROM pg_stat_activity a
+			WHERE a.datname = pg_database.datname
+		)`, cutoff)
+	if err != nil {
+		return nil, fmt.Errorf("cannot find stale test databases: %w", err)
+	}
+
+	var dropped []string
+	var firstErr error
+	for _, name := range schemas {
+		ok, err := dropStaleSchema(ctx, db, name)
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("cannot drop stale test schema %s: %w", name, err)
+		}
+		if ok {
+			dropped = append(dropped, name)
+		}
+	}
+	for _, name := range databases {
+		_, err := db.ExecContext(ctx, "DROP DATABASE "+pq.QuoteIdentifier(name))
+		switch {
+		case err == nil:
+			dropped = append(dropped, name)
+		case SQLState(err) == "55006":
+			// object_in_use: someone has connected since we looked.
+		case firstErr == nil:
+			firstErr = fmt.Errorf("cannot drop stale test database %s: %w", name, err)
+		}
+	}
+	return dropped, firstErr
+}
+
+// staleObjects returns the names from the given query, which returns
+// names and comments, whose comments record a creation time before
+// cutoff.
+func staleObjects(ctx context.Context, db *sql.DB, query string, cutoff time.Time) ([]string, error) {
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		var comment sql.NullString
+		if err := rows.Scan(&name, &comment); err != nil {
+			return nil, err
+		}
+		if created, ok := parseCreatedComment(comment.String); ok && created.Before(cutoff) {
+			names = append(names, name)
+		}
+	}
+	return names, rows.Err()
+}
+
+// dropStaleSchema drops the named schema unless something in it is
+// locked by another session, reporting whether it was dropped.
+func dropStaleSchema(ctx context.Context, db *sql.DB, name string) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "SET LOCAL lock_timeout = '100ms'"); err != nil {
+		return false, err
+	}
+	if _, err := tx.ExecContext(ctx, "DROP SCHEMA "+pq.QuoteIdentifier(name)+" CASCADE"); err != nil {
+		if SQLState(err) == "55P03" {
+			// lock_not_available: the schema is still in use.
+			return false, nil
+		}
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
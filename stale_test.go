@@ -0,0 +1,58 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/postgrestest"
+)
+
+func TestCleanupStale(t *testing.T) {
+	c := qt.New(t)
+	stale, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	// Closing will fail because the schema has already gone.
+	defer stale.Close()
+	fresh, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer fresh.Close()
+	_, err = stale.Exec(`COMMENT ON SCHEMA ` + stale.Schema() + ` IS 'postgrestest: created 2000-01-01T00:00:00Z'`)
+	c.Assert(err, qt.Equals, nil)
+
+	dropped, err := postgrestest.CleanupStale(context.Background(), time.Hour)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(contains(dropped, stale.Schema()), qt.Equals, true)
+	c.Assert(contains(dropped, fresh.Schema()), qt.Equals, false)
+
+	var count int
+	err = fresh.QueryRow(`SELECT COUNT(*) FROM pg_namespace WHERE nspname = $1`, stale.Schema()).Scan(&count)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(count, qt.Equals, 0)
+}
+
+func contains(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestWithStaleCleanupUsesDSN(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	c.Setenv("PGTESTDISABLE", "")
+	// Nothing should be listening on port 1, so the cleanup fails
+	// only if it connects with the parameters from WithDSN.
+	_, err := postgrestest.NewWithOptions(
+		postgrestest.WithDSN("host=127.0.0.1 port=1"),
+		postgrestest.WithStaleCleanup(time.Hour),
+	)
+	c.Assert(err, qt.ErrorMatches, `cannot find stale test schemas: .*127\.0\.0\.1:1.*`)
+}
@@ -0,0 +1,145 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// structureQueries holds queries that together describe the
+// structure of a schema. Each returns a single text column and
+// takes the schema name as its only argument.
+var structureQueries = []string{`
+	SELECT format('column %s.%s %s nullable=%s default=%s',
+		table_name, column_name, data_type, is_nullable, column_default)
+	FROM information_schema.columns
+	WHERE table_schema = $1`, `
+	SELECT format('constraint %s.%s %s',
+		conrelid::regclass, conname, pg_get_constraintdef(oid))
+	FROM pg_constraint
+	WHERE connamespace = $1::regnamespace`, `
+	SELECT format('index %s', indexdef)
+	FROM pg_indexes
+	WHERE schemaname = $1`, `
+	SELECT format('view %s %s', table_name, view_definition)
+	FROM information_schema.views
+	WHERE table_schema = $1`,
+}
+
+// structure returns a description of the structure of the test
+// schema as a sorted list of lines, suitable for comparing with
+// diffLines.
+func (pg *DB) structure() ([]string, error) {
+	var lines []string
+	for _, q := range structureQueries {
+		rows, err := pg.DB.Query(q, pg.schema)
+		if err != nil {
+			return nil, fmt.Errorf("cannot query schema structure: %w", err)
+		}
+		for rows.Next() {
+			var line string
+			if err := rows.Scan(&line); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("cannot scan schema structure: %w", err)
+			}
+			lines = append(lines, line)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("cannot query schema structure: %w", err)
+		}
+	}
+	sort.Strings(lines)
+	return lines, nil
+}
+
+// diffLines returns a description of the differences between
+// two sorted lists of lines, or the empty string if there are
+// none. Removed lines are prefixed with "-" and added lines with
+// "+".
+func diffLines(before, after []string) string {
+	in := func(lines []string, line string) bool {
+		i := sort.SearchStrings(lines, line)
+		return i < len(lines) && lines[i] == line
+	}
+	var diff []string
+	for _, line := range before {
+		if !in(after, line) {
+			diff = append(diff, "-"+line)
+		}
+	}
+	for _, line := range after {
+		if !in(before, line) {
+			diff = append(diff, "+"+line)
+		}
+	}
+	return strings.Join(diff, "\n")
+}
+
+// AssertIdempotent checks that the SQL migration in the file at the
+// given path is idempotent. It applies the migration to the test
+// schema twice and fails the test if the second application returns
+// an error or changes the structure of the schema (its columns,
+// constraints, indexes or views). This is useful for checking
+// migrations written with IF NOT EXISTS clauses. The file may be
+// gzip-compressed, as with LoadSQLFile.
+func (pg *DB) AssertIdempotent(t testing.TB, sqlPath string) {
+	t.Helper()
+	if err := pg.LoadSQLFile(sqlPath); err != nil {
+		t.Fatalf("cannot apply migration: %v", err)
+	}
+	before, err := pg.structure()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pg.LoadSQLFile(sqlPath); err != nil {
+		t.Errorf("migration %s is not idempotent: second application failed: %v", sqlPath, err)
+		return
+	}
+	after, err := pg.structure()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := diffLines(before, after); diff != "" {
+		t.Errorf("migration %s is not idempotent: second application changed the schema:\n%s", sqlPath, diff)
+	}
+}
+
+// SnapshotStructure records the current structure of the test schema
+// (its columns, constraints, indexes and views) so that it can later
+// be checked with AssertNoStructureChange. It is typically called
+// after migrations have been applied, just before the body of the
+// test runs.
+func (pg *DB) SnapshotStructure() error {
+	snapshot, err := pg.structure()
+	if err != nil {
+		return err
+	}
+	if snapshot == nil {
+		// Distinguish an empty schema from no snapshot.
+		snapshot = []string{}
+	}
+	pg.snapshot = snapshot
+	return nil
+}
+
+// AssertNoStructureChange fails the test if the structure of the test
+// schema differs from that recorded by the last call to
+// SnapshotStructure. This catches tests that accidentally run DDL.
+func (pg *DB) AssertNoStructureChange(t testing.TB) {
+	t.Helper()
+	if pg.snapshot == nil {
+		t.Fatal("AssertNoStructureChange called without SnapshotStructure")
+	}
+	now, err := pg.structure()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := diffLines(pg.snapshot, now); diff != "" {
+		t.Errorf("schema structure changed since snapshot:\n%s", diff)
+	}
+}
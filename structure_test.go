@@ -0,0 +1,104 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/postgrestest"
+)
+
+var assertIdempotentTests = []struct {
+	about       string
+	migration   string
+	expectError string
+}{{
+	about: "idempotent",
+	migration: `
+		CREATE TABLE IF NOT EXISTS x (id integer PRIMARY KEY, val text);
+		CREATE INDEX IF NOT EXISTS x_val ON x (val);
+	`,
+}, {
+	about:       "error on second application",
+	migration:   `CREATE TABLE x (id integer)`,
+	expectError: `migration .*migration.sql is not idempotent: second application failed: .*already exists`,
+}, {
+	about: "structure changed on second application",
+	migration: `
+		CREATE TABLE IF NOT EXISTS x (id integer);
+		CREATE INDEX ON x (id);
+	`,
+	expectError: `(?s)migration .*migration.sql is not idempotent: second application changed the schema:\n\+index CREATE INDEX x_id_idx1 .*`,
+}}
+
+func TestAssertIdempotent(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	for _, test := range assertIdempotentTests {
+		c.Run(test.about, func(c *qt.C) {
+			db, err := postgrestest.New()
+			c.Assert(err, qt.Equals, nil)
+			defer db.Close()
+
+			path := filepath.Join(c.Mkdir(), "migration.sql")
+			err = ioutil.WriteFile(path, []byte(test.migration), 0666)
+			c.Assert(err, qt.Equals, nil)
+			rt := &recordingTB{TB: t}
+			db.AssertIdempotent(rt, path)
+			if test.expectError == "" {
+				c.Assert(rt.errors, qt.HasLen, 0)
+				return
+			}
+			c.Assert(rt.errors, qt.HasLen, 1)
+			c.Assert(rt.errors[0], qt.Matches, test.expectError)
+		})
+	}
+}
+
+func TestAssertNoStructureChange(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+
+	_, err = db.Exec(`CREATE TABLE x (id integer PRIMARY KEY)`)
+	c.Assert(err, qt.Equals, nil)
+	err = db.SnapshotStructure()
+	c.Assert(err, qt.Equals, nil)
+
+	// Changing data is fine.
+	_, err = db.Exec(`INSERT INTO x VALUES (1)`)
+	c.Assert(err, qt.Equals, nil)
+	db.AssertNoStructureChange(t)
+
+	_, err = db.Exec(`ALTER TABLE x ADD COLUMN val text`)
+	c.Assert(err, qt.Equals, nil)
+	rt := &recordingTB{TB: t}
+	db.AssertNoStructureChange(rt)
+	c.Assert(rt.errors, qt.DeepEquals, []string{
+		"schema structure changed since snapshot:\n+column x.val text nullable=YES default=",
+	})
+}
+
+func TestWithSnapshotStructure(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.NewWithOptions(
+		postgrestest.WithSnapshotStructure(),
+		postgrestest.WithSchemaSQL(`CREATE TABLE x (id integer PRIMARY KEY)`),
+	)
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+
+	// The snapshot is taken after the schema has been set up.
+	db.AssertNoStructureChange(t)
+
+	_, err = db.Exec(`CREATE INDEX x_id ON x (id)`)
+	c.Assert(err, qt.Equals, nil)
+	rt := &recordingTB{TB: t}
+	db.AssertNoStructureChange(rt)
+	c.Assert(rt.errors, qt.HasLen, 1)
+}
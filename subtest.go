@@ -0,0 +1,74 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+)
+
+// Querier holds the methods common to *sql.DB and *sql.Tx. It is
+// used by SubtestWith, which passes either a database handle or a
+// transaction depending on the reset strategy.
+type Querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// ResetStrategy selects how SubtestWith isolates subtests from each
+// other.
+type ResetStrategy int
+
+const (
+	// ResetTruncate removes all the data with Reset before each
+	// subtest. The subtest is given the DB's own handle, so it may
+	// commit transactions and use more than one connection.
+	ResetTruncate ResetStrategy = iota
+
+	// ResetRollback runs each subtest in a transaction started by
+	// BeginTest, which is rolled back when the subtest completes.
+	// This is cheaper than truncating the tables, but the subtest
+	// is limited to a single connection and must not commit.
+	ResetRollback
+)
+
+// SubtestWith runs body as a subtest of t with the given name, as
+// t.Run does, after resetting the test schema with the given strategy
+// and calling seed, if it is not nil, to insert the data that the
+// subtest starts with. Both functions are given the same Querier, so
+// with ResetRollback the seed data is rolled back along with
+// everything else. An error from Reset or seed fails the subtest
+// before body is called.
+//
+// Subtests that use ResetTruncate share the schema and so must not be
+// run in parallel.
+func (pg *DB) SubtestWith(t *testing.T, name string, strategy ResetStrategy, seed func(q Querier) error, body func(t *testing.T, q Querier)) bool {
+	t.Helper()
+	return t.Run(name, func(t *testing.T) {
+		t.Helper()
+		var q Querier
+		switch strategy {
+		case ResetTruncate:
+			if err := pg.Reset(); err != nil {
+				t.Fatal(err)
+			}
+			q = pg.DB
+		case ResetRollback:
+			q = pg.BeginTest(t)
+		default:
+			t.Fatalf("unknown reset strategy %d", strategy)
+		}
+		if seed != nil {
+			if err := seed(q); err != nil {
+				t.Fatalf("cannot seed test data: %v", err)
+			}
+		}
+		body(t, q)
+	})
+}
@@ -0,0 +1,46 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest_test
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/postgrestest"
+)
+
+func TestSubtestWith(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+	_, err = db.Exec(`CREATE TABLE x (id serial, val text)`)
+	c.Assert(err, qt.Equals, nil)
+
+	seed := func(q postgrestest.Querier) error {
+		_, err := q.Exec(`INSERT INTO x (val) VALUES ('seed')`)
+		return err
+	}
+	for _, strategy := range []postgrestest.ResetStrategy{postgrestest.ResetTruncate, postgrestest.ResetRollback} {
+		for _, name := range []string{"one", "two"} {
+			db.SubtestWith(t, name, strategy, seed, func(t *testing.T, q postgrestest.Querier) {
+				c := qt.New(t)
+				// Each subtest sees only the seed data.
+				var count int
+				err := q.QueryRow(`SELECT COUNT(*) FROM x`).Scan(&count)
+				c.Assert(err, qt.Equals, nil)
+				c.Assert(count, qt.Equals, 1)
+				_, err = q.Exec(`INSERT INTO x (val) VALUES ($1)`, name)
+				c.Assert(err, qt.Equals, nil)
+			})
+		}
+	}
+
+	// The data from the last subtest was rolled back, leaving that
+	// of the last truncated one.
+	var count int
+	err = db.QueryRow(`SELECT COUNT(*) FROM x`).Scan(&count)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(count, qt.Equals, 2)
+}
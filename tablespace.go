@@ -0,0 +1,76 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// NewTempTablespace creates a new tablespace with a random name
+// located in a newly created temporary directory. It returns the
+// name of the tablespace and a function that drops the tablespace
+// and removes the directory.
+//
+// This has strict prerequisites: the connecting role must be a
+// superuser, and the Postgres server must be running on the local
+// machine as the same user as the test, because Postgres requires
+// the tablespace directory to be owned by the server's OS user.
+//
+// A tablespace cannot be dropped while it still contains objects,
+// so the cleanup function should normally be called after the DB
+// has been closed. It uses its own connection so that it is
+// still usable at that point. For example:
+//
+//	name, cleanup, err := db.NewTempTablespace()
+//	...
+//	defer cleanup()
+//	defer db.Close()
+func (pg *DB) NewTempTablespace() (name string, cleanup func(), err error) {
+	dir, err := ioutil.TempDir("", "postgrestest")
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot create tablespace directory: %w", err)
+	}
+	name = randomName("go_test_ts_")
+	err = runWithTimeout(func(done chan error) {
+		_, err := pg.DB.Exec(fmt.Sprintf("CREATE TABLESPACE %q LOCATION '%s'", name, dir))
+		done <- err
+	}, defaultTimeout, "create tablespace "+name)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", nil, err
+	}
+	cleanup = func() {
+		if err := pg.dropTablespace(name); err != nil {
+			fmt.Fprintf(os.Stderr, "postgrestest: %v\n", err)
+		}
+		os.RemoveAll(dir)
+	}
+	return name, cleanup, nil
+}
+
+// dropTablespace drops the named tablespace using a new connection
+// to the same server as pg. A database created by NewDB is dropped
+// when pg is closed, so the connection then goes to the default
+// database instead.
+func (pg *DB) dropTablespace(name string) error {
+	params, err := parseConnString(pg.dataSource)
+	if err != nil {
+		return fmt.Errorf("cannot parse connection string: %w", err)
+	}
+	if pg.database != "" {
+		delete(params, "dbname")
+	}
+	db, err := sql.Open(pg.driverName, connString(params))
+	if err != nil {
+		return fmt.Errorf("cannot open database: %w", err)
+	}
+	defer db.Close()
+	return runWithTimeout(func(done chan error) {
+		_, err := db.Exec(fmt.Sprintf("DROP TABLESPACE %q", name))
+		done <- err
+	}, defaultTimeout, "drop tablespace "+name)
+}
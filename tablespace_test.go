@@ -0,0 +1,31 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest_test
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/postgrestest"
+)
+
+func TestNewTempTablespace(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+	skipUnlessSuperuser(c, db)
+	name, cleanup, err := db.NewTempTablespace()
+	c.Assert(err, qt.Equals, nil)
+	defer cleanup()
+	// Drop the table before the tablespace is removed.
+	defer db.Exec(`DROP TABLE x`)
+
+	_, err = db.Exec(`CREATE TABLE x (id text) TABLESPACE ` + name)
+	c.Assert(err, qt.Equals, nil)
+	var got string
+	err = db.QueryRow(`SELECT tablespace FROM pg_tables WHERE schemaname = $1 AND tablename = 'x'`, db.Schema()).Scan(&got)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(got, qt.Equals, name)
+}
@@ -0,0 +1,91 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// NewFromTemplate is like NewDB except that the new database is a
+// copy of the named template database. This can be much faster than
+// creating a schema and applying migrations for every test: migrate
+// the template database once and clone it as required.
+//
+// Postgres cannot copy a database while other sessions are connected
+// to it, so the template should not be in use, and in particular it
+// must not be the database named by PGDATABASE, which is used to issue
+// the CREATE DATABASE statement. If the template is briefly in use, for
+// example by a connection that is still closing, creating the database
+// is retried a few times before giving up.
+func NewFromTemplate(templateName string) (*DB, error) {
+	return newDatabase(templateName)
+}
+
+// ResetToTemplate replaces a database created by NewFromTemplate, or
+// by Template.Clone, with a fresh copy of its template under the same
+// name, restoring both its structure and its data. The template must
+// still exist and, as for NewFromTemplate, must not be in use; in
+// particular a Template must not be closed while databases cloned
+// from it may still be reset.
+//
+// Copying a database is quick compared with creating a schema and
+// running migrations, but it is slower than Reset, which only
+// truncates the tables and so cannot undo changes to the structure.
+// The database has to be dropped and created again, which is done
+// with new connections: all the connections in the pool are closed
+// first, so connection settings made with methods such as
+// SetMaxOpenConns are lost, and handles returned by Open are closed.
+// Snapshots taken with Snapshot and connection tracking started by
+// TrackConns are discarded along with the old database.
+func (pg *DB) ResetToTemplate() error {
+	if pg.template == "" {
+		return errors.New("cannot reset to template: database was not created from a template")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pg.opTimeout())
+	defer cancel()
+	pg.closeMu.Lock()
+	defer pg.closeMu.Unlock()
+	if pg.closed {
+		return errors.New("cannot reset to template: test database has been closed")
+	}
+	pg.conns.Stop()
+	pg.conns = nil
+	pg.dataSnapshots = nil
+	for _, db := range pg.extra {
+		db.Close()
+	}
+	pg.extra = nil
+	if !pg.dropped {
+		// The database cannot be dropped while we are still
+		// connected to it.
+		err := runWithContext(ctx, func(context.Context) error {
+			return pg.DB.Close()
+		}, "close test db")
+		if err != nil {
+			return err
+		}
+		if err := dropDatabase(ctx, pg.database); err != nil {
+			return err
+		}
+		pg.dropped = true
+	}
+	admin, err := sql.Open("postgres", "")
+	if err != nil {
+		return fmt.Errorf("cannot open database: %w", err)
+	}
+	defer admin.Close()
+	if err := createDatabase(ctx, admin, pg.database, pg.template); err != nil {
+		return err
+	}
+	pg.dropped = false
+	db, err := openDatabase(ctx, pg.database, pg.dataSource)
+	if err != nil {
+		return err
+	}
+	pg.DB = db
+	return nil
+}
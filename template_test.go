@@ -0,0 +1,94 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest_test
+
+import (
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/postgrestest"
+)
+
+func TestNewFromTemplate(t *testing.T) {
+	c := qt.New(t)
+	admin, err := postgrestest.NewConn()
+	c.Assert(err, qt.Equals, nil)
+	defer admin.Close()
+	skipUnlessSuperuser(c, admin)
+
+	// Create a template database holding a table.
+	template := fmt.Sprintf("go_test_template_%d", time.Now().UnixNano())
+	_, err = admin.Exec(`CREATE DATABASE ` + template)
+	c.Assert(err, qt.Equals, nil)
+	defer admin.Exec(`DROP DATABASE ` + template)
+	tdb, err := sql.Open("postgres", "dbname="+template)
+	c.Assert(err, qt.Equals, nil)
+	_, err = tdb.Exec(`CREATE TABLE x (id text); INSERT INTO x VALUES ('a')`)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(tdb.Close(), qt.Equals, nil)
+
+	db, err := postgrestest.NewFromTemplate(template)
+	c.Assert(err, qt.Equals, nil)
+	var name, id string
+	err = db.QueryRow(`SELECT current_database(), id FROM x`).Scan(&name, &id)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(id, qt.Equals, "a")
+	c.Assert(name, qt.Not(qt.Equals), template)
+	c.Assert(db.Schema(), qt.Equals, "public")
+	c.Assert(db.Close(), qt.Equals, nil)
+
+	// Check that the new database has been dropped.
+	var count int
+	err = admin.QueryRow(`SELECT COUNT(*) FROM pg_database WHERE datname = $1`, name).Scan(&count)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(count, qt.Equals, 0)
+}
+
+func TestResetToTemplate(t *testing.T) {
+	c := qt.New(t)
+	admin, err := postgrestest.NewConn()
+	c.Assert(err, qt.Equals, nil)
+	defer admin.Close()
+	skipUnlessSuperuser(c, admin)
+
+	tmpl, err := postgrestest.NewTemplate(func(db *sql.DB) error {
+		_, err := db.Exec(`CREATE TABLE x (id text); INSERT INTO x VALUES ('a')`)
+		return err
+	})
+	c.Assert(err, qt.Equals, nil)
+	defer tmpl.Close()
+	db, err := postgrestest.NewFromTemplate(tmpl.Name())
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+	var name string
+	err = db.QueryRow(`SELECT current_database()`).Scan(&name)
+	c.Assert(err, qt.Equals, nil)
+
+	// Change both the data and the structure.
+	_, err = db.Exec(`INSERT INTO x VALUES ('b'); CREATE TABLE y (id text)`)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(db.ResetToTemplate(), qt.Equals, nil)
+
+	var newName string
+	var count int
+	err = db.QueryRow(`SELECT current_database(), COUNT(*) FROM x`).Scan(&newName, &count)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(newName, qt.Equals, name)
+	c.Assert(count, qt.Equals, 1)
+	tables, err := db.Tables()
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(tables, qt.DeepEquals, []string{"x"})
+}
+
+func TestResetToTemplateWithoutTemplate(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+	err = db.ResetToTemplate()
+	c.Assert(err, qt.ErrorMatches, `cannot reset to template: database was not created from a template`)
+}
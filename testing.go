@@ -0,0 +1,74 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest
+
+import (
+	"errors"
+	"testing"
+)
+
+// NewForTest is like New except that errors are reported through the
+// given test, and the DB is closed automatically when the test and
+// all its subtests complete. If postgres testing has been disabled
+// with PGTESTDISABLE, or the server does not meet the requirements
+// given by options such as WithMinVersion, the test is skipped; any
+// other error fails the test immediately. An error closing the DB
+// also fails the test.
+//
+// If the test fails, the name of the test schema is logged so that
+// it can be inspected; set PGTESTKEEPDB or use WithKeepOnFailure to
+// stop it being deleted. If statements are being recorded (see
+// Statements), they are logged too.
+//
+// The DB is configured with the given options as for NewWithOptions.
+//
+// The returned DB may still be closed explicitly; see Close.
+func NewForTest(t testing.TB, opts ...Option) *DB {
+	t.Helper()
+	db, err := NewWithOptions(opts...)
+	return forTest(t, db, err)
+}
+
+// forTest implements NewForTest for a DB created by some other means.
+// It reports err through t or arranges for db to be closed when t
+// completes.
+func forTest(t testing.TB, db *DB, err error) *DB {
+	t.Helper()
+	if err == ErrDisabled || errors.Is(err, ErrUnsupported) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if t.Failed() {
+			db.closeMu.Lock()
+			db.keep = db.keep || db.keepOnFailure
+			db.closeMu.Unlock()
+			logTestDB(t, db)
+		}
+		if err := db.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+	return db
+}
+
+// logTestDB logs the name of the schema or database used by a failed
+// test, and any statements recorded.
+func logTestDB(t testing.TB, db *DB) {
+	t.Helper()
+	what := "schema " + db.schema
+	if db.database != "" {
+		what = "database " + db.database
+	}
+	for _, s := range db.Statements() {
+		t.Logf("postgrestest: %v", s)
+	}
+	if db.keepDB() {
+		t.Logf("postgrestest: test failed; keeping %s", what)
+	} else {
+		t.Logf("postgrestest: test failed using %s (set PGTESTKEEPDB to keep it)", what)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest_test
+
+import (
+	"database/sql"
+	"fmt"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/postgrestest"
+)
+
+func TestNewForTest(t *testing.T) {
+	c := qt.New(t)
+	var schema string
+	t.Run("sub", func(t *testing.T) {
+		db := postgrestest.NewForTest(t)
+		schema = db.Schema()
+		_, err := db.Exec(`CREATE TABLE x (id integer)`)
+		qt.New(t).Assert(err, qt.Equals, nil)
+	})
+
+	// The schema should have been removed by the subtest's cleanup.
+	sdb, err := sql.Open("postgres", "")
+	c.Assert(err, qt.Equals, nil)
+	defer sdb.Close()
+	var count int
+	err = sdb.QueryRow(`SELECT COUNT(nspname) FROM pg_namespace WHERE nspname = $1`, schema).Scan(&count)
+	c.Assert(err, qt.Equals, nil)
+	c.Assert(count, qt.Equals, 0)
+}
+
+func TestNewForTestDisabled(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	c.Setenv("PGTESTDISABLE", "1")
+	var skipped bool
+	t.Run("sub", func(t *testing.T) {
+		defer func() {
+			skipped = t.Skipped()
+		}()
+		postgrestest.NewForTest(t)
+		t.Error("NewForTest returned when testing was disabled")
+	})
+	c.Assert(skipped, qt.Equals, true)
+}
+
+func TestNewForTestLogsSchemaOnFailure(t *testing.T) {
+	c := qt.New(t)
+	defer c.Done()
+	c.Setenv("PGTESTKEEPDB", "")
+	c.Setenv("PGTESTLOG", "")
+	ft := &failedTB{TB: t}
+	db := postgrestest.NewForTest(ft)
+	ft.runCleanups()
+	c.Assert(ft.logs, qt.DeepEquals, []string{
+		"postgrestest: test failed using schema " + db.Schema() + " (set PGTESTKEEPDB to keep it)",
+	})
+}
+
+// failedTB behaves as a failed test, recording log messages and
+// running cleanup functions only when asked.
+type failedTB struct {
+	testing.TB
+	logs     []string
+	cleanups []func()
+}
+
+func (t *failedTB) Failed() bool {
+	return true
+}
+
+func (t *failedTB) Logf(f string, a ...interface{}) {
+	t.logs = append(t.logs, fmt.Sprintf(f, a...))
+}
+
+func (t *failedTB) Cleanup(f func()) {
+	t.cleanups = append(t.cleanups, f)
+}
+
+func (t *failedTB) runCleanups() {
+	for i := len(t.cleanups) - 1; i >= 0; i-- {
+		t.cleanups[i]()
+	}
+}
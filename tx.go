@@ -0,0 +1,76 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// TestTx holds a transaction started by BeginTest. Everything done
+// in the transaction is rolled back when the test completes.
+type TestTx struct {
+	*sql.Tx
+
+	mu         sync.Mutex
+	savepoints int
+}
+
+// BeginTest starts a transaction that is rolled back when the given
+// test and all its subtests complete. This is a much cheaper way of
+// isolating tests that do not need to commit than creating a schema
+// for each one: create one DB, for example in TestMain, and have each
+// test use its own transaction in it. Errors are reported through t.
+//
+// Note that the transaction holds a single connection, and statements
+// that cannot run inside a transaction, such as CREATE DATABASE, will
+// fail.
+func (pg *DB) BeginTest(t testing.TB) *TestTx {
+	t.Helper()
+	tx, err := pg.DB.Begin()
+	if err != nil {
+		t.Fatalf("cannot begin test transaction: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			t.Errorf("cannot roll back test transaction: %v", err)
+		}
+	})
+	return &TestTx{
+		Tx: tx,
+	}
+}
+
+// Savepoint starts a sub-transaction, using a savepoint, that is
+// rolled back when the given test and all its subtests complete. This
+// is intended for subtests that share the transaction of their parent
+// test but should not see each other's changes. For example:
+//
+//	tx := db.BeginTest(t)
+//	// set up data shared by the subtests
+//	t.Run("sub", func(t *testing.T) {
+//		tx.Savepoint(t)
+//		...
+//	})
+//
+// Because the subtests share a connection, they must not be run in
+// parallel.
+func (tx *TestTx) Savepoint(t testing.TB) {
+	t.Helper()
+	tx.mu.Lock()
+	tx.savepoints++
+	name := fmt.Sprintf("postgrestest_%d", tx.savepoints)
+	tx.mu.Unlock()
+	if _, err := tx.Exec("SAVEPOINT " + name); err != nil {
+		t.Fatalf("cannot create savepoint: %v", err)
+	}
+	t.Cleanup(func() {
+		if _, err := tx.Exec("ROLLBACK TO SAVEPOINT " + name + "; RELEASE SAVEPOINT " + name); err != nil {
+			t.Errorf("cannot roll back savepoint: %v", err)
+		}
+	})
+}
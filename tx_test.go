@@ -0,0 +1,49 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest_test
+
+import (
+	"database/sql"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/postgrestest"
+)
+
+func TestBeginTest(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+	_, err = db.Exec(`CREATE TABLE x (id integer)`)
+	c.Assert(err, qt.Equals, nil)
+	count := func(c *qt.C, q interface {
+		QueryRow(string, ...interface{}) *sql.Row
+	}) int {
+		var n int
+		err := q.QueryRow(`SELECT COUNT(*) FROM x`).Scan(&n)
+		c.Assert(err, qt.Equals, nil)
+		return n
+	}
+
+	t.Run("tx", func(t *testing.T) {
+		c := qt.New(t)
+		tx := db.BeginTest(t)
+		_, err := tx.Exec(`INSERT INTO x VALUES (1)`)
+		c.Assert(err, qt.Equals, nil)
+		for _, name := range []string{"sub1", "sub2"} {
+			t.Run(name, func(t *testing.T) {
+				c := qt.New(t)
+				tx.Savepoint(t)
+				// The other subtest's row is not visible.
+				c.Assert(count(c, tx), qt.Equals, 1)
+				_, err := tx.Exec(`INSERT INTO x VALUES (2)`)
+				c.Assert(err, qt.Equals, nil)
+			})
+		}
+		c.Assert(count(c, tx), qt.Equals, 1)
+	})
+	// Everything has been rolled back.
+	c.Assert(count(c, db), qt.Equals, 0)
+}
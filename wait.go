@@ -0,0 +1,81 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+	"time"
+)
+
+// defaultWaitInterval holds the initial interval between attempts to
+// connect in WaitUntilReady.
+const defaultWaitInterval = 100 * time.Millisecond
+
+// WaitUntilReady waits until the server configured by the given
+// connection string and the PG* environment variables accepts
+// connections, or the context is done. This is useful in CI, where
+// the server may still be starting when the tests begin.
+//
+// Connection attempts are retried with a backoff while the connection
+// is refused or reset, the Unix socket does not exist yet, or the
+// server reports that it is starting up. Other errors, such as
+// authentication failures, unknown host names or SSL mismatches, are
+// returned immediately. If the context is done first, the returned
+// error matches ErrUnavailable.
+func WaitUntilReady(ctx context.Context, dsn string) error {
+	return waitUntilReady(ctx, "postgres", dsn, defaultWaitInterval)
+}
+
+// waitUntilReady implements WaitUntilReady, using the given driver and
+// initial interval between attempts.
+func waitUntilReady(ctx context.Context, driverName, dsn string, interval time.Duration) error {
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return fmt.Errorf("cannot open database: %w", err)
+	}
+	defer db.Close()
+	wait := interval
+	for {
+		err := db.PingContext(ctx)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() == nil && !notReady(err) {
+			return fmt.Errorf("cannot connect to database: %w", err)
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return &unavailableError{
+				cause: fmt.Errorf("server not ready before %v: %w", ctx.Err(), err),
+				hint:  connectionHint(),
+			}
+		}
+		if wait *= 2; wait > maxPollBackoff*interval {
+			wait = maxPollBackoff * interval
+		}
+	}
+}
+
+// notReady reports whether the given connection error may be because
+// the server is not ready yet.
+func notReady(err error) bool {
+	if SQLState(err) == "57P03" {
+		// cannot_connect_now: the server is starting up.
+		return true
+	}
+	// The server is not listening yet, or closed the connection
+	// while starting up. Other errors, such as a host name that
+	// cannot be resolved or an SSL mismatch, will not go away.
+	return errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ENOENT) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
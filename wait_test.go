@@ -0,0 +1,74 @@
+// Copyright 2017 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package postgrestest_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/juju/postgrestest"
+)
+
+func TestWaitUntilReady(t *testing.T) {
+	c := qt.New(t)
+	db, err := postgrestest.New()
+	c.Assert(err, qt.Equals, nil)
+	defer db.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c.Assert(postgrestest.WaitUntilReady(ctx, db.DSN()), qt.Equals, nil)
+}
+
+func TestWaitUntilReadyTimeout(t *testing.T) {
+	c := qt.New(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	// Nothing should be listening on port 1.
+	err := postgrestest.WaitUntilReady(ctx, "host=localhost port=1 sslmode=disable")
+	c.Assert(err, qt.ErrorMatches, `postgres server is unavailable: server not ready before context deadline exceeded: .*`)
+	c.Assert(errors.Is(err, postgrestest.ErrUnavailable), qt.Equals, true)
+}
+
+func TestWaitUntilReadySSLNotEnabled(t *testing.T) {
+	c := qt.New(t)
+	// Listen like a server that does not support SSL.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, qt.Equals, nil)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				// Read the SSLRequest and decline it.
+				buf := make([]byte, 8)
+				if _, err := io.ReadFull(conn, buf); err != nil {
+					return
+				}
+				conn.Write([]byte("N"))
+				io.Copy(ioutil.Discard, conn)
+			}()
+		}
+	}()
+	host, port, err := net.SplitHostPort(l.Addr().String())
+	c.Assert(err, qt.Equals, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	err = postgrestest.WaitUntilReady(ctx, "host="+host+" port="+port+" sslmode=require")
+	c.Assert(err, qt.ErrorMatches, `cannot connect to database: pq: SSL is not enabled on the server`)
+	c.Assert(errors.Is(err, postgrestest.ErrUnavailable), qt.Equals, false)
+	// The error is returned without waiting.
+	c.Assert(time.Since(start) < time.Second, qt.Equals, true)
+}